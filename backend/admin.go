@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// handleAdminDisconnect forcibly removes a producer, e.g. a camera stuck
+// sending garbage. The producer is sent a close frame before its connection
+// is dropped; its read loop then exits without removing the client again.
+func (ss *StreamServer) handleAdminDisconnect(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	if !ss.kickClient(client, "disconnected by administrator") {
+		clientNotFound(w) // Already gone
+		return
+	}
+	slog.Warn("client disconnected by administrator", "event", "admin_disconnect", "clientId", clientID, "remoteAddr", r.RemoteAddr)
+	ss.audit.Record(AuditEvent{
+		Event:      "admin_disconnect",
+		Identity:   requestIdentity(r),
+		RemoteAddr: r.RemoteAddr,
+		Cameras:    []string{clientID},
+		Path:       r.URL.Path,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"clientId": clientID, "disconnected": true})
+}
+
+// kickClient sends the producer a close frame with reason and removes it,
+// reporting false if it was already gone.
+func (ss *StreamServer) kickClient(client *Client, reason string) bool {
+	closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	conn := client.connection()
+	conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	return ss.removeClientConn(client.ID, conn)
+}
+
+// handleAdminRotateKey replaces a client's producer key. The body may give
+// the new key as {"key":"..."}; otherwise one is generated and returned.
+// With "disconnect": true the current connection is dropped so the camera
+// must register again with the new key. The client need not be connected.
+func (ss *StreamServer) handleAdminRotateKey(w http.ResponseWriter, r *http.Request) {
+	if ss.producerKeys == nil {
+		writeError(w, http.StatusConflict, "auth-disabled", "producer authentication is disabled")
+		return
+	}
+	clientID := mux.Vars(r)["id"]
+	var req struct {
+		Key        string `json:"key"`
+		Disconnect bool   `json:"disconnect"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		badRequest(w, "invalid request body")
+		return
+	}
+	generated := req.Key == ""
+	if generated {
+		req.Key = newProducerKey()
+	}
+	if err := ss.producerKeys.SetKey(clientID, req.Key); err != nil {
+		slog.Error("producer key rotation failed", "event", "admin_rotate_key", "clientId", clientID, "err", err)
+		writeError(w, http.StatusInternalServerError, "internal-error", "could not store key")
+		return
+	}
+	disconnected := false
+	if client, ok := ss.GetClient(clientID); ok && req.Disconnect {
+		disconnected = ss.kickClient(client, "producer key rotated")
+	}
+	slog.Warn("producer key rotated by administrator", "event", "admin_rotate_key", "clientId", clientID, "disconnected", disconnected, "remoteAddr", r.RemoteAddr)
+	ss.audit.Record(AuditEvent{
+		Event:      "admin_rotate_key",
+		Identity:   requestIdentity(r),
+		RemoteAddr: r.RemoteAddr,
+		Cameras:    []string{clientID},
+		Path:       r.URL.Path,
+	})
+	resp := map[string]interface{}{"clientId": clientID, "rotated": true, "disconnected": disconnected}
+	if generated {
+		resp["key"] = req.Key
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdminPause stops broadcasting a client's frames, e.g. for a privacy
+// mode, while its ring buffer keeps filling for the admin buffer endpoint.
+func (ss *StreamServer) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	ss.setClientPaused(w, r, true)
+}
+
+// handleAdminResume restarts broadcasting after handleAdminPause.
+func (ss *StreamServer) handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	ss.setClientPaused(w, r, false)
+}
+
+// setClientPaused implements pause and resume. Viewers of the client are
+// told with a client-paused or client-resumed message.
+func (ss *StreamServer) setClientPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	if client.SetPaused(paused) {
+		event, msgType := "admin_resume", "client-resumed"
+		if paused {
+			event, msgType = "admin_pause", "client-paused"
+		}
+		slog.Info("client broadcasting changed by administrator", "event", event, "clientId", clientID, "remoteAddr", r.RemoteAddr)
+		ss.audit.Record(AuditEvent{
+			Event:      event,
+			Identity:   requestIdentity(r),
+			RemoteAddr: r.RemoteAddr,
+			Cameras:    []string{clientID},
+			Path:       r.URL.Path,
+		})
+		data, _ := json.Marshal(map[string]interface{}{"type": msgType, "clientId": clientID})
+		ss.broadcastJSON(clientID, data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"clientId": clientID, "paused": paused})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiError is the envelope every /api error response uses, so programmatic
+// consumers can always parse a failure:
+//
+//	{"error":{"code":"client-not-found","message":"no client with this ID is connected"}}
+//
+// Codes are stable kebab-case identifiers, like protocol error reasons;
+// messages are for humans and may change.
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError sends an apiError with status.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{apiErrorBody{Code: code, Message: message}})
+}
+
+// clientNotFound answers a request for a client that isn't connected.
+func clientNotFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "client-not-found", "no client with this ID is connected")
+}
+
+// noFrames answers a request for frames a client's buffer doesn't hold.
+func noFrames(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "no-frames", "no matching frames are buffered for this client")
+}
+
+// badRequest answers a request with an invalid parameter or body.
+func badRequest(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusBadRequest, "invalid-request", message)
+}
+
+// handleUnmatchedAPI sets api's not-found and method-not-allowed handlers
+// to answer with an apiError. gorilla/mux reports a method mismatch inside
+// a subrouter as not found once a later route fails to match, so a miss is
+// retried with the other methods the API uses to tell 404 from 405.
+func handleUnmatchedAPI(api *mux.Router) {
+	notAllowed := func(w http.ResponseWriter, r *http.Request, allowed []string) {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method-not-allowed", r.Method+" is not supported on this endpoint")
+	}
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notAllowed(w, r, allowedMethods(api, r))
+	})
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed := allowedMethods(api, r); len(allowed) > 0 {
+			notAllowed(w, r, allowed)
+			return
+		}
+		writeError(w, http.StatusNotFound, "not-found", "no such API endpoint")
+	})
+}
+
+// allowedMethods returns the methods other than r's that a route in api
+// would accept for r's path.
+func allowedMethods(api *mux.Router, r *http.Request) []string {
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if method == r.Method {
+			continue
+		}
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if api.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
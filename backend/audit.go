@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a single record written to the audit sink
+type AuditEvent struct {
+	Time            time.Time  `json:"time"`
+	Event           string     `json:"event"`
+	SessionID       string     `json:"sessionId,omitempty"`
+	Identity        string     `json:"identity"`
+	RemoteAddr      string     `json:"remoteAddr"`
+	Cameras         []string   `json:"cameras,omitempty"`
+	Path            string     `json:"path,omitempty"`
+	SessionStart    *time.Time `json:"sessionStart,omitempty"`
+	SessionEnd      *time.Time `json:"sessionEnd,omitempty"`
+	FramesDelivered uint64     `json:"framesDelivered,omitempty"`
+}
+
+// AuditLog writes access records for surveillance footage to a dedicated
+// sink, separate from the operational log. A nil *AuditLog discards events.
+type AuditLog struct {
+	mutex sync.Mutex
+	w     io.WriteCloser
+}
+
+// NewAuditLog opens the audit sink described by target: "syslog" (or
+// "syslog:<tag>") writes to the local syslog daemon, "-" writes to stdout,
+// and anything else is treated as a file path opened in append mode.
+// An empty target disables auditing and returns nil.
+func NewAuditLog(target string) (*AuditLog, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case target == "-":
+		return &AuditLog{w: nopCloser{os.Stdout}}, nil
+	case target == "syslog" || strings.HasPrefix(target, "syslog:"):
+		tag := strings.TrimPrefix(strings.TrimPrefix(target, "syslog"), ":")
+		if tag == "" {
+			tag = "skysentry-audit"
+		}
+		w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+		if err != nil {
+			return nil, fmt.Errorf("open audit syslog: %w", err)
+		}
+		return &AuditLog{w: w}, nil
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open audit file: %w", err)
+		}
+		return &AuditLog{w: f}, nil
+	}
+}
+
+// Record writes one event as a JSON line. Failures are reported on the
+// operational log but never interrupt streaming.
+func (a *AuditLog) Record(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("audit marshal failed", "event", "audit_error", "err", err)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		slog.Error("audit write failed", "event", "audit_error", "err", err)
+	}
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.w.Close()
+}
+
+// recordAccess audits a REST request that returned frames of clientID.
+func (ss *StreamServer) recordAccess(r *http.Request, clientID string, frames int) {
+	ss.audit.Record(AuditEvent{
+		Event:           "snapshot_access",
+		Identity:        requestIdentity(r),
+		RemoteAddr:      r.RemoteAddr,
+		Cameras:         []string{clientID},
+		Path:            r.URL.Path,
+		FramesDelivered: uint64(frames),
+	})
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
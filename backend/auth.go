@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TokenValidator reports whether token grants access to the stream of
+// clientID, and the principal it authenticates for the audit log.
+type TokenValidator func(clientID, token string) (principal string, ok bool)
+
+// VIEWER_TOKEN_PRINCIPAL is the audit identity of viewers authenticated by
+// the shared -viewer-token rather than a named key.
+const VIEWER_TOKEN_PRINCIPAL = "viewer-token"
+
+// tokensEqual compares secrets in constant time.
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// NewProducerValidator builds the producer check from a shared secret and a
+// per-client key store. A client with a key in keys must present its own
+// key; any other client must present the shared secret. Either way the
+// principal is the client ID. When neither is configured it returns nil,
+// which leaves registration open.
+func NewProducerValidator(sharedSecret string, keys KeyStore) TokenValidator {
+	if sharedSecret == "" && keys == nil {
+		return nil
+	}
+	return func(clientID, token string) (string, bool) {
+		if token == "" {
+			return "", false
+		}
+		if keys != nil {
+			if key, ok := keys.Key(clientID); ok {
+				return clientID, tokensEqual(token, key)
+			}
+		}
+		return clientID, sharedSecret != "" && tokensEqual(token, sharedSecret)
+	}
+}
+
+// NewViewerValidator builds the viewer check from a shared secret and named
+// viewer keys. A named key authenticates its name; the shared secret
+// authenticates VIEWER_TOKEN_PRINCIPAL. Viewers aren't tied to one client,
+// so the clientID argument is ignored. Without a secret or keys it returns
+// nil, which leaves streams public.
+func NewViewerValidator(sharedSecret string, keys map[string]string) TokenValidator {
+	if sharedSecret == "" && len(keys) == 0 {
+		return nil
+	}
+	return func(_, token string) (string, bool) {
+		if token == "" {
+			return "", false
+		}
+		for name, key := range keys {
+			if tokensEqual(token, key) {
+				return name, true
+			}
+		}
+		if sharedSecret != "" && tokensEqual(token, sharedSecret) {
+			return VIEWER_TOKEN_PRINCIPAL, true
+		}
+		return "", false
+	}
+}
+
+// LoadKeys reads a JSON object mapping names, such as client IDs, to their
+// keys. kind names the keys in errors.
+func LoadKeys(path, kind string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s keys: %w", kind, err)
+	}
+	keys := make(map[string]string)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse %s keys: %w", kind, err)
+	}
+	return keys, nil
+}
+
+type principalKey struct{}
+
+// withPrincipal records who authenticated r, see requestIdentity.
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// requestIdentity returns the principal r was authenticated as, or its
+// remote address when the endpoint doesn't require authentication.
+func requestIdentity(r *http.Request) string {
+	if principal, ok := r.Context().Value(principalKey{}).(string); ok && principal != "" {
+		return principal
+	}
+	return r.RemoteAddr
+}
+
+// requireAdmin wraps an admin handler so it only runs for requests carrying
+// "Authorization: Bearer <token>". Without a configured token the admin API
+// is disabled and every request is refused.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, http.StatusForbidden, "admin-disabled", "admin API is disabled")
+			return
+		}
+		if !adminRequest(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="skysentry-admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+			return
+		}
+		next(w, withPrincipal(r, "admin"))
+	}
+}
+
+// adminRequest reports whether r carries "Authorization: Bearer <token>"
+// for a configured admin token, for public endpoints that reveal more to
+// administrators.
+func adminRequest(r *http.Request, token string) bool {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && tokensEqual(presented, token)
+}
+
+// requireViewer wraps a frame endpoint so it only runs for requests carrying
+// a viewer token, either as "?token=" (EventSource, <img> and WebSocket
+// clients can't set headers) or as "Authorization: Bearer <token>". A nil
+// validator lets every request through.
+func requireViewer(validate TokenValidator, next http.HandlerFunc) http.HandlerFunc {
+	if validate == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := validate("", viewerToken(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="skysentry"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+			return
+		}
+		next(w, withPrincipal(r, principal))
+	}
+}
+
+// viewerToken returns the token a viewer presented on the request, if any.
+func viewerToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
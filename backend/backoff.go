@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DEFAULT_RETRY_AFTER  = 5 * time.Second
+	DEFAULT_RETRY_JITTER = 5 * time.Second
+)
+
+// RetryHint is the backoff advice given to clients whose connection or
+// request was rejected because the server is overloaded. Clients should wait
+// After plus a random amount up to Jitter before retrying, so a fleet that
+// was rejected together does not reconnect together.
+type RetryHint struct {
+	After  time.Duration
+	Jitter time.Duration
+}
+
+// Suggest returns a concrete delay with jitter already applied, for
+// transports such as the Retry-After header that can only carry one value.
+func (h RetryHint) Suggest() time.Duration {
+	d := h.After
+	if h.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(h.Jitter)))
+	}
+	return d
+}
+
+// rejection is the payload sent on a websocket before it is closed for
+// overload reasons.
+type rejection struct {
+	Type          string `json:"type"`
+	Reason        string `json:"reason"`
+	RetryAfterMs  int64  `json:"retryAfterMs"`
+	RetryJitterMs int64  `json:"retryJitterMs"`
+}
+
+// rejectHTTP writes an overload response (typically 429 or 503) carrying a
+// Retry-After header in whole seconds. The body is the usual apiError with
+// reason as its code, plus the retry hints.
+func (ss *StreamServer) rejectHTTP(w http.ResponseWriter, status int, reason string) {
+	secs := int(math.Ceil(ss.config.Retry.Suggest().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		apiError
+		RetryAfter    int   `json:"retryAfter"`
+		RetryJitterMs int64 `json:"retryJitterMs"`
+	}{
+		apiError:      apiError{apiErrorBody{Code: reason, Message: "server is busy, retry after the suggested delay"}},
+		RetryAfter:    secs,
+		RetryJitterMs: ss.config.Retry.Jitter.Milliseconds(),
+	})
+}
+
+// rejectWebSocket sends a rejection message with backoff hints on an
+// already-upgraded connection and closes it.
+func (ss *StreamServer) rejectWebSocket(conn *websocket.Conn, msgType, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.WriteJSON(rejection{
+		Type:          msgType,
+		Reason:        reason,
+		RetryAfterMs:  ss.config.Retry.After.Milliseconds(),
+		RetryJitterMs: ss.config.Retry.Jitter.Milliseconds(),
+	})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason))
+	conn.Close()
+}
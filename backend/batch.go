@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Producers that negotiate "batch": true at registration may pack several
+// frames into one binary message: the BATCH_HEADER byte, then for each frame
+// a big-endian uint32 length followed by that many bytes of image data. The
+// header can't be mistaken for the first byte of a JPEG, PNG or WebP, so
+// unbatched frames are still accepted on the same connection.
+const (
+	BATCH_HEADER      = 0xBA
+	MAX_BATCH_FRAMES  = 16
+	BATCH_READ_FACTOR = 4 // A batch message may be this many times -max-frame-size
+)
+
+var ErrMalformedBatch = errors.New("malformed batch")
+
+// isBatch reports whether a binary message uses the batch framing.
+func isBatch(data []byte) bool {
+	return len(data) > 0 && data[0] == BATCH_HEADER
+}
+
+// parseBatch splits a batch message into its frames, which share data's
+// backing array. Every length is checked against the bytes remaining and
+// against maxFrameSize before anything is sliced.
+func parseBatch(data []byte, maxFrameSize int) ([][]byte, error) {
+	if !isBatch(data) {
+		return nil, fmt.Errorf("%w: missing header", ErrMalformedBatch)
+	}
+	rest := data[1:]
+	var frames [][]byte
+	for len(rest) > 0 {
+		if len(frames) == MAX_BATCH_FRAMES {
+			return nil, fmt.Errorf("%w: more than %d frames", ErrMalformedBatch, MAX_BATCH_FRAMES)
+		}
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("%w: truncated length", ErrMalformedBatch)
+		}
+		n := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(n) > uint64(maxFrameSize) {
+			return nil, fmt.Errorf("%w: frame %d is %d bytes, limit %d", ErrFrameTooLarge, len(frames), n, maxFrameSize)
+		}
+		if uint64(n) > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: frame %d is truncated", ErrMalformedBatch, len(frames))
+		}
+		frames = append(frames, rest[:n:n])
+		rest = rest[n:]
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("%w: no frames", ErrMalformedBatch)
+	}
+	return frames, nil
+}
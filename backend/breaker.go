@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// A viewer that keeps dropping most of its frames is better off reconnecting
+// (perhaps at a lower quality) than staying connected in a permanently
+// degraded state, holding a buffer and logging every drop.
+
+const (
+	SLOW_VIEWER_WINDOW     = 10 * time.Second // Period over which a viewer's drop rate is measured
+	SLOW_VIEWER_MIN_FRAMES = 30               // Frames a window needs before it is judged
+	SLOW_VIEWER_DROP_RATIO = 0.5              // Default share of dropped frames that disconnects a viewer
+)
+
+// dropWindow counts frames offered to a viewer and how many were dropped
+// during the current SLOW_VIEWER_WINDOW.
+type dropWindow struct {
+	start   time.Time
+	offered int
+	dropped int
+}
+
+// record counts a frame offered at now. When a window completes, it reports
+// whether more than ratio of that window's frames were dropped and starts a
+// new one.
+func (w *dropWindow) record(dropped bool, now time.Time, ratio float64) (tooSlow bool) {
+	if w.start.IsZero() {
+		w.start = now
+	}
+	if now.Sub(w.start) >= SLOW_VIEWER_WINDOW {
+		tooSlow = w.offered >= SLOW_VIEWER_MIN_FRAMES && float64(w.dropped) > ratio*float64(w.offered)
+		*w = dropWindow{start: now}
+	}
+	w.offered++
+	if dropped {
+		w.dropped++
+	}
+	return tooSlow
+}
+
+// recordOffered tracks the viewer's drop rate and reports whether it should
+// be disconnected. A ratio of 0 disables the check.
+func (v *Viewer) recordOffered(dropped bool, now time.Time, ratio float64) bool {
+	if ratio <= 0 {
+		return false
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.drops.record(dropped, now, ratio)
+}
+
+// disconnect asks the viewer's writer to send a disconnected message with
+// reason and close the connection. It is safe to call more than once and
+// while holding viewersMutex; the viewer is removed by its handler as usual.
+func (v *Viewer) disconnect(reason string) {
+	v.kickOnce.Do(func() {
+		v.kickReason = reason
+		close(v.kick)
+	})
+}
+
+// disconnectMessage returns the message telling the viewer why it is being
+// disconnected. Only valid once kick is closed.
+func (v *Viewer) disconnectMessage() []byte {
+	data, _ := json.Marshal(map[string]string{"type": "disconnected", "reason": v.kickReason})
+	return data
+}
@@ -0,0 +1,44 @@
+package main
+
+// supportedFormats lists the image formats detectFormat accepts.
+var supportedFormats = []string{"jpeg", "png", "webp"}
+
+// capabilities describes what the server accepts from a producer, sent in
+// registration-success so clients can adapt without out-of-band config.
+type capabilities struct {
+	MaxFrameSize   int      `json:"maxFrameSize"` // Bytes per frame
+	Formats        []string `json:"formats"`
+	Binary         bool     `json:"binary"`          // Raw binary frames are accepted
+	Batch          bool     `json:"batch"`           // Batching is enabled on this connection
+	MaxBatchFrames int      `json:"maxBatchFrames"`  // Frames per batch message when batching
+	Compression    bool     `json:"compression"`     // permessage-deflate on the producer socket
+	Checksums      bool     `json:"verifyChecksums"` // Frame checksums are verified on this connection
+	BufferSize     int      `json:"bufferSize"`      // Ring buffer assigned to this client
+	RecommendedFps float64  `json:"recommendedFps"`  // Frames faster than this are dropped or never reach viewers
+
+	RetryAfterMs  int64 `json:"retryAfterMs"` // Backoff to use when reconnecting, see RetryHint
+	RetryJitterMs int64 `json:"retryJitterMs"`
+}
+
+// producerCapabilities builds the capabilities for a producer registered
+// with opts. The recommended rate is the ingest cap, further limited to
+// MAX_BROADCAST_FPS since viewers never receive more than that.
+func (ss *StreamServer) producerCapabilities(opts ClientOptions, batch bool) capabilities {
+	fps := float64(MAX_BROADCAST_FPS)
+	if opts.MaxFps > 0 {
+		fps = min(opts.MaxFps, fps)
+	}
+	return capabilities{
+		MaxFrameSize:   ss.config.MaxFrameSize,
+		Formats:        supportedFormats,
+		Binary:         true,
+		Batch:          batch,
+		MaxBatchFrames: MAX_BATCH_FRAMES,
+		Compression:    ss.upgrader.EnableCompression,
+		Checksums:      opts.Verify,
+		BufferSize:     opts.BufferSize,
+		RecommendedFps: fps,
+		RetryAfterMs:   ss.config.Retry.After.Milliseconds(),
+		RetryJitterMs:  ss.config.Retry.Jitter.Milliseconds(),
+	}
+}
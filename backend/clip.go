@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+)
+
+const (
+	CLIP_SECONDS     = 5  // Default ?seconds= for GIF clips
+	CLIP_MAX_SECONDS = 30 // Longest clip that may be requested
+	CLIP_MAX_FRAMES  = 100
+	CLIP_WIDTH       = 320 // Default ?w= for GIF clips
+	CLIP_MAX_WIDTH   = 640
+)
+
+// handleClip encodes the last ?seconds= of a client's ring buffer as an
+// animated GIF scaled to ?w= pixels wide, with frame delays taken from the
+// receive timestamps. Only buffered frames are available, so the clip is
+// shorter than requested when the buffer holds less history. Longer clips
+// are thinned to CLIP_MAX_FRAMES evenly spaced frames to bound memory.
+func (ss *StreamServer) handleClip(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	seconds := CLIP_SECONDS
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > CLIP_MAX_SECONDS {
+			badRequest(w, "seconds must be between 1 and 30")
+			return
+		}
+		seconds = n
+	}
+	width := CLIP_WIDTH
+	if v := r.URL.Query().Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > CLIP_MAX_WIDTH {
+			badRequest(w, "w must be between 1 and 640")
+			return
+		}
+		width = n
+	}
+
+	frames := clipFrames(ss.unexpired(client.Buffer.Snapshot()), time.Duration(seconds)*time.Second)
+	if len(frames) == 0 {
+		noFrames(w)
+		return
+	}
+	anim := &gif.GIF{}
+	for i, frame := range frames {
+		src, _, err := decodeImage(frame.Data, ss.config.MaxDecodePixels)
+		if err != nil {
+			continue // Skip frames in formats we can't decode
+		}
+		scaled := scaleImage(src, width)
+		img := image.NewPaletted(scaled.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(img, img.Bounds(), scaled, image.Point{})
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, clipDelay(frames, i))
+	}
+	if len(anim.Image) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "undecodable-frame", "frames could not be decoded")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal-error", err.Error())
+		return
+	}
+	ss.recordAccess(r, clientID, len(anim.Image))
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+// clipFrames returns the frames (oldest first) received within span of the
+// newest one, thinned to at most CLIP_MAX_FRAMES.
+func clipFrames(frames []*Frame, span time.Duration) []*Frame {
+	if len(frames) == 0 {
+		return nil
+	}
+	cutoff := frames[len(frames)-1].Timestamp.Add(-span)
+	start := 0
+	for start < len(frames)-1 && frames[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	frames = frames[start:]
+	if len(frames) <= CLIP_MAX_FRAMES {
+		return frames
+	}
+	thinned := make([]*Frame, CLIP_MAX_FRAMES)
+	for i := range thinned {
+		thinned[i] = frames[i*len(frames)/CLIP_MAX_FRAMES]
+	}
+	return thinned
+}
+
+// clipDelay returns how long frame i stays on screen, in the GIF's 1/100s
+// units: the gap to the next frame, or the previous gap for the last one.
+func clipDelay(frames []*Frame, i int) int {
+	var gap time.Duration
+	switch {
+	case i+1 < len(frames):
+		gap = frames[i+1].Timestamp.Sub(frames[i].Timestamp)
+	case i > 0:
+		gap = frames[i].Timestamp.Sub(frames[i-1].Timestamp)
+	}
+	return max(2, int(gap/(10*time.Millisecond))) // Browsers treat delays under 2 as slow
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// comparedFrame describes one side of a comparison.
+type comparedFrame struct {
+	ClientID    string    `json:"clientId"`
+	Seq         uint64    `json:"seq"`
+	Timestamp   time.Time `json:"timestamp"`
+	CaptureTime time.Time `json:"captureTime"`
+	Size        int       `json:"size"`
+	Format      string    `json:"format"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+}
+
+// frameComparison is the response of /api/compare.
+type frameComparison struct {
+	A          comparedFrame `json:"a"`
+	B          comparedFrame `json:"b"`
+	Similarity float64       `json:"similarity"` // 1 - motionScore of the two frames
+	OffsetMs   int64         `json:"offsetMs"`   // B's receive time minus A's
+}
+
+// handleCompare scores how alike the latest frames of clients ?a= and ?b=
+// are, using the motion detector's downscaled grayscale diff. Two cameras
+// covering the same scene should stay close to 1; a camera that stops
+// updating shows up as similarity 1 with a growing offsetMs.
+func (ss *StreamServer) handleCompare(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	idA, idB := q.Get("a"), q.Get("b")
+	if idA == "" || idB == "" {
+		badRequest(w, "a and b must name the clients to compare")
+		return
+	}
+	var frames [2]*Frame
+	var thumbs [2][]float64
+	var sides [2]comparedFrame
+	for i, id := range []string{idA, idB} {
+		client, ok := ss.GetClient(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "client-not-found", "no client "+id+" is connected")
+			return
+		}
+		frame := client.Buffer.GetLatest()
+		if frame == nil {
+			writeError(w, http.StatusNotFound, "no-frames", "no frames are buffered for "+id)
+			return
+		}
+		if ss.expired(frame) {
+			writeError(w, http.StatusNotFound, "no-frames", "the latest frame of "+id+" has expired")
+			return
+		}
+		img, _, err := decodeImage(frame.Data, ss.config.MaxDecodePixels)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "undecodable-frame", "latest frame of "+id+" could not be decoded")
+			return
+		}
+		frames[i] = frame
+		thumbs[i] = grayThumbnail(img)
+		sides[i] = comparedFrame{
+			ClientID:    id,
+			Seq:         frame.Seq,
+			Timestamp:   frame.Timestamp,
+			CaptureTime: frame.CaptureTime,
+			Size:        frame.Size,
+			Format:      frame.Format,
+			Width:       img.Bounds().Dx(),
+			Height:      img.Bounds().Dy(),
+		}
+	}
+	ss.recordAccess(r, idA, 1)
+	ss.recordAccess(r, idB, 1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(frameComparison{
+		A:          sides[0],
+		B:          sides[1],
+		Similarity: 1 - motionScore(thumbs[0], thumbs[1]),
+		OffsetMs:   frames[1].Timestamp.Sub(frames[0].Timestamp).Milliseconds(),
+	})
+}
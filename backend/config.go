@@ -0,0 +1,377 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_PORT = "8080"
+
+// Config holds the server's tunables. Values come from command-line flags,
+// falling back to SKYSENTRY_* environment variables and then to the
+// compiled-in defaults.
+type Config struct {
+	Port            string
+	BufferSize      int
+	MaxBufferSize   int // Largest ring buffer a producer may request
+	MaxFrameSize    int
+	MaxDecodePixels int // Largest width×height decoded for thumbnails, re-encoding and analysis
+	MaxClients      int // Concurrent producer limit, 0 for unlimited
+	MaxViewers      int // Concurrent viewer limit, 0 for unlimited
+	ClientTimeout   time.Duration
+	CleanupInterval time.Duration
+	StaleAfter      time.Duration // Report a stream as stale after this long without frames, 0 never
+	FrameTTL        time.Duration // Stop serving frames older than this, 0 never
+	LiveOnly        bool          // Keep only the latest frame per client, see bufferSize
+	CoalesceWindow  time.Duration // Broadcast only the last frame of each burst this long, 0 off
+	ReconnectGrace  time.Duration // Keep a dropped producer's client this long for it to reattach, 0 off
+
+	NormalizeMaxWidth  int // Bounds of frames from producers that ask for normalization, see normalize.go
+	NormalizeMaxHeight int
+	NormalizeQuality   int // JPEG quality of normalized frames
+	NormalizeWorkers   int // Goroutines normalizing frames, 0 for one per CPU
+
+	ViewerIdleTimeout   time.Duration // Close viewers that stop answering pings, 0 to rely on PONG_WAIT
+	ViewerCompression   bool          // Offer permessage-deflate to viewers; producers never use it
+	ViewerWriteTimeout  time.Duration // Disconnect viewers when a single write takes longer
+	ViewerBuffer        int           // Messages queued per viewer before frames are dropped
+	SlowViewerDropRatio float64       // Disconnect viewers dropping more than this share of frames, 0 never
+
+	AuditLog     string    // Audit sink target, see NewAuditLog
+	Retry        RetryHint // Backoff advice for clients rejected under load
+	SubscribeAll bool      // Deliver every stream to viewers without a subscription
+
+	ProducerToken    string // Shared secret producers must present on registration
+	ProducerKeysFile string // JSON file of per-client producer keys
+	ViewerToken      string // Shared secret viewers must present, see requireViewer
+	ViewerKeysFile   string // JSON file of named viewer keys, recorded as the audit identity
+	DuplicateIDs     string // DUPLICATE_REJECT, DUPLICATE_SUFFIX or DUPLICATE_REPLACE, see resolveDuplicate
+
+	TLSCert string // PEM certificate path; TLS is enabled when both are set
+	TLSKey  string // PEM private key path
+
+	ReadHeaderTimeout time.Duration // Time allowed to read request headers, see newHTTPServer
+	IdleTimeout       time.Duration // Keep-alive connections idle this long are closed
+	HTTP2             bool          // Offer HTTP/2 when TLS is enabled
+	BasePath          string        // Prefix for every route, e.g. "/skysentry"; empty serves from the root
+
+	RecordDir      string // Persist incoming frames under this directory when set
+	RecordMaxBytes int64  // Disk cap for recorded frames, 0 for unlimited
+	RecordMode     string // RECORD_MODE_ALL or RECORD_MODE_MOTION
+	RecordPreRoll  time.Duration
+	RecordPostRoll time.Duration
+
+	RecordSegmentDuration time.Duration // Start a new recording segment this often, 0 never
+	RecordSegmentBytes    int64         // Start a new recording segment before this many bytes, 0 never
+
+	MaxIngestFps float64 // Per-producer ingest cap, 0 for unlimited
+	MessageRate  float64 // Messages per second any WebSocket may send, 0 for unlimited
+	APIRate      float64 // REST requests per second per remote IP, 0 for unlimited
+
+	AllowedOrigins []string // Browser origins allowed to open WebSockets, see originChecker
+
+	WebhookURL string // Endpoint that receives connection events when set
+	AdminToken string // Bearer token for /api/admin, which is disabled when empty
+
+	MotionThreshold float64       // Motion score that triggers an alert, 0 disables detection
+	MotionInterval  time.Duration // Time between motion samples per client
+
+	LogLevel  slog.Level
+	LogFormat string // "json" or "text"
+	AccessLog bool   // Log every /api request, see accessLog
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden.
+func DefaultConfig() Config {
+	return Config{
+		Port:                DEFAULT_PORT,
+		BufferSize:          BUFFER_SIZE,
+		MaxBufferSize:       MAX_BUFFER_SIZE,
+		MaxFrameSize:        MAX_FRAME_SIZE,
+		MaxDecodePixels:     MAX_DECODE_PIXELS,
+		ClientTimeout:       CLIENT_TIMEOUT,
+		StaleAfter:          STALE_AFTER,
+		ViewerWriteTimeout:  VIEWER_WRITE_WAIT,
+		ViewerBuffer:        VIEWER_BUFFER,
+		SlowViewerDropRatio: SLOW_VIEWER_DROP_RATIO,
+		CleanupInterval:     CLEANUP_INTERVAL,
+		Retry:               RetryHint{After: DEFAULT_RETRY_AFTER, Jitter: DEFAULT_RETRY_JITTER},
+		SubscribeAll:        true,
+		MessageRate:         MAX_MESSAGE_RATE,
+		MotionInterval:      MOTION_INTERVAL,
+		RecordMode:          RECORD_MODE_ALL,
+		DuplicateIDs:        DUPLICATE_REPLACE,
+		RecordPreRoll:       RECORD_PRE_ROLL,
+		RecordPostRoll:      RECORD_POST_ROLL,
+		LogLevel:            slog.LevelInfo,
+		LogFormat:           "json",
+		ReadHeaderTimeout:   READ_HEADER_TIMEOUT,
+		IdleTimeout:         IDLE_TIMEOUT,
+		HTTP2:               true,
+		NormalizeMaxWidth:   NORMALIZE_MAX_WIDTH,
+		NormalizeMaxHeight:  NORMALIZE_MAX_HEIGHT,
+		NormalizeQuality:    NORMALIZE_QUALITY,
+	}
+}
+
+// LoadConfig parses args (normally os.Args[1:]) on top of the environment.
+func LoadConfig(args []string) (Config, error) {
+	def := DefaultConfig()
+	cfg := def
+
+	fs := flag.NewFlagSet("skysentry-server", flag.ContinueOnError)
+	fs.StringVar(&cfg.Port, "port", envString("SKYSENTRY_PORT", def.Port), "listen port or host:port (env SKYSENTRY_PORT)")
+	fs.StringVar(&cfg.BasePath, "base-path", envString("SKYSENTRY_BASE_PATH", def.BasePath), "serve every route under this URL prefix, e.g. /skysentry, for path-based reverse proxies (env SKYSENTRY_BASE_PATH)")
+	fs.IntVar(&cfg.BufferSize, "buffer-size", envInt("SKYSENTRY_BUFFER_SIZE", def.BufferSize), "frames kept per client ring buffer (env SKYSENTRY_BUFFER_SIZE)")
+	fs.IntVar(&cfg.MaxBufferSize, "max-buffer-size", envInt("SKYSENTRY_MAX_BUFFER_SIZE", def.MaxBufferSize), "largest ring buffer a producer may request at registration (env SKYSENTRY_MAX_BUFFER_SIZE)")
+	fs.BoolVar(&cfg.LiveOnly, "live-only", envBool("SKYSENTRY_LIVE_ONLY", def.LiveOnly), "keep only the latest frame of every client instead of a history buffer (env SKYSENTRY_LIVE_ONLY)")
+	fs.DurationVar(&cfg.CoalesceWindow, "coalesce-window", envDuration("SKYSENTRY_COALESCE_WINDOW", def.CoalesceWindow), "broadcast only the newest of the frames a producer sends within this window, e.g. 50ms; every frame is still buffered, 0 disables (env SKYSENTRY_COALESCE_WINDOW)")
+	fs.IntVar(&cfg.MaxFrameSize, "max-frame-size", envInt("SKYSENTRY_MAX_FRAME_SIZE", def.MaxFrameSize), "largest accepted producer frame in bytes (env SKYSENTRY_MAX_FRAME_SIZE)")
+	fs.IntVar(&cfg.MaxDecodePixels, "max-decode-pixels", envInt("SKYSENTRY_MAX_DECODE_PIXELS", def.MaxDecodePixels), "largest frame, in width×height pixels, the server will decode for thumbnails, clips, quality, WebP, normalizing and motion detection (env SKYSENTRY_MAX_DECODE_PIXELS)")
+	fs.IntVar(&cfg.MaxClients, "max-clients", envInt("SKYSENTRY_MAX_CLIENTS", def.MaxClients), "maximum concurrent producers, 0 for unlimited (env SKYSENTRY_MAX_CLIENTS)")
+	fs.IntVar(&cfg.MaxViewers, "max-viewers", envInt("SKYSENTRY_MAX_VIEWERS", def.MaxViewers), "maximum concurrent viewers, 0 for unlimited (env SKYSENTRY_MAX_VIEWERS)")
+	fs.DurationVar(&cfg.ClientTimeout, "client-timeout", envDuration("SKYSENTRY_CLIENT_TIMEOUT", def.ClientTimeout), "drop producers silent for this long (env SKYSENTRY_CLIENT_TIMEOUT)")
+	fs.DurationVar(&cfg.ViewerIdleTimeout, "viewer-idle-timeout", envDuration("SKYSENTRY_VIEWER_IDLE_TIMEOUT", def.ViewerIdleTimeout), "close viewers that answer no pings for this long, 0 to disable (env SKYSENTRY_VIEWER_IDLE_TIMEOUT)")
+	fs.DurationVar(&cfg.ViewerWriteTimeout, "viewer-write-timeout", envDuration("SKYSENTRY_VIEWER_WRITE_TIMEOUT", def.ViewerWriteTimeout), "disconnect viewers when a single write takes longer than this (env SKYSENTRY_VIEWER_WRITE_TIMEOUT)")
+	fs.Float64Var(&cfg.SlowViewerDropRatio, "slow-viewer-drop-ratio", envFloat("SKYSENTRY_SLOW_VIEWER_DROP_RATIO", def.SlowViewerDropRatio), "disconnect viewers that drop more than this share (0-1) of frames over 10s, 0 to disable (env SKYSENTRY_SLOW_VIEWER_DROP_RATIO)")
+	fs.IntVar(&cfg.ViewerBuffer, "viewer-buffer", envInt("SKYSENTRY_VIEWER_BUFFER", def.ViewerBuffer), "messages queued per viewer before frames are dropped; at 60fps each 60 adds a second of latency (env SKYSENTRY_VIEWER_BUFFER)")
+	fs.BoolVar(&cfg.ViewerCompression, "viewer-compression", envBool("SKYSENTRY_VIEWER_COMPRESSION", def.ViewerCompression), "offer permessage-deflate on viewer WebSockets (env SKYSENTRY_VIEWER_COMPRESSION)")
+	fs.DurationVar(&cfg.FrameTTL, "frame-ttl", envDuration("SKYSENTRY_FRAME_TTL", def.FrameTTL), "stop serving frames older than this, answering latest-frame requests with 204, 0 to disable (env SKYSENTRY_FRAME_TTL)")
+	fs.DurationVar(&cfg.StaleAfter, "stale-after", envDuration("SKYSENTRY_STALE_AFTER", def.StaleAfter), "report streams without frames for this long as stale, 0 to disable (env SKYSENTRY_STALE_AFTER)")
+	fs.DurationVar(&cfg.ReconnectGrace, "reconnect-grace", envDuration("SKYSENTRY_RECONNECT_GRACE", def.ReconnectGrace), "keep a disconnected producer's buffer and stats this long so re-registering the same ID resumes them, 0 disables (env SKYSENTRY_RECONNECT_GRACE)")
+	fs.IntVar(&cfg.NormalizeMaxWidth, "normalize-max-width", envInt("SKYSENTRY_NORMALIZE_MAX_WIDTH", def.NormalizeMaxWidth), "largest width frames of producers registered with normalize are scaled to (env SKYSENTRY_NORMALIZE_MAX_WIDTH)")
+	fs.IntVar(&cfg.NormalizeMaxHeight, "normalize-max-height", envInt("SKYSENTRY_NORMALIZE_MAX_HEIGHT", def.NormalizeMaxHeight), "largest height frames of producers registered with normalize are scaled to (env SKYSENTRY_NORMALIZE_MAX_HEIGHT)")
+	fs.IntVar(&cfg.NormalizeQuality, "normalize-quality", envInt("SKYSENTRY_NORMALIZE_QUALITY", def.NormalizeQuality), "JPEG quality (1-100) normalized frames are re-encoded at (env SKYSENTRY_NORMALIZE_QUALITY)")
+	fs.IntVar(&cfg.NormalizeWorkers, "normalize-workers", envInt("SKYSENTRY_NORMALIZE_WORKERS", def.NormalizeWorkers), "goroutines re-encoding normalized frames, 0 for one per CPU (env SKYSENTRY_NORMALIZE_WORKERS)")
+	fs.DurationVar(&cfg.CleanupInterval, "cleanup-interval", envDuration("SKYSENTRY_CLEANUP_INTERVAL", def.CleanupInterval), "how often inactive producers are swept (env SKYSENTRY_CLEANUP_INTERVAL)")
+	fs.StringVar(&cfg.AuditLog, "audit-log", envString("SKYSENTRY_AUDIT_LOG", def.AuditLog), `audit sink for footage access: file path, "syslog[:tag]" or "-" for stdout, disabled when empty (env SKYSENTRY_AUDIT_LOG)`)
+	fs.DurationVar(&cfg.Retry.After, "retry-after", envDuration("SKYSENTRY_RETRY_AFTER", def.Retry.After), "minimum backoff suggested to clients rejected under load (env SKYSENTRY_RETRY_AFTER)")
+	fs.DurationVar(&cfg.Retry.Jitter, "retry-jitter", envDuration("SKYSENTRY_RETRY_JITTER", def.Retry.Jitter), "random jitter range added on top of -retry-after (env SKYSENTRY_RETRY_JITTER)")
+	fs.BoolVar(&cfg.SubscribeAll, "subscribe-all", envBool("SKYSENTRY_SUBSCRIBE_ALL", def.SubscribeAll), "send every stream to viewers that have not subscribed to a specific client (env SKYSENTRY_SUBSCRIBE_ALL)")
+	fs.StringVar(&cfg.ViewerToken, "viewer-token", envString("SKYSENTRY_VIEWER_TOKEN", def.ViewerToken), "shared secret viewers must send to watch streams (env SKYSENTRY_VIEWER_TOKEN)")
+	fs.StringVar(&cfg.ViewerKeysFile, "viewer-keys", envString("SKYSENTRY_VIEWER_KEYS", def.ViewerKeysFile), "JSON file mapping viewer names to their keys; the name is recorded in the audit log (env SKYSENTRY_VIEWER_KEYS)")
+	fs.StringVar(&cfg.ProducerToken, "producer-token", envString("SKYSENTRY_PRODUCER_TOKEN", def.ProducerToken), "shared secret producers must send when registering (env SKYSENTRY_PRODUCER_TOKEN)")
+	fs.StringVar(&cfg.ProducerKeysFile, "producer-keys", envString("SKYSENTRY_PRODUCER_KEYS", def.ProducerKeysFile), "JSON file mapping client IDs to per-client keys (env SKYSENTRY_PRODUCER_KEYS)")
+	fs.StringVar(&cfg.DuplicateIDs, "duplicate-ids", envString("SKYSENTRY_DUPLICATE_IDS", def.DuplicateIDs), `when producers keep taking over each other's client ID: "reject" the newcomer, "suffix" it as <id>-2, or "replace" as usual, the default (env SKYSENTRY_DUPLICATE_IDS)`)
+	fs.StringVar(&cfg.TLSCert, "tls-cert", envString("SKYSENTRY_TLS_CERT", def.TLSCert), "TLS certificate file; serves HTTPS/WSS together with -tls-key (env SKYSENTRY_TLS_CERT)")
+	fs.StringVar(&cfg.TLSKey, "tls-key", envString("SKYSENTRY_TLS_KEY", def.TLSKey), "TLS private key file (env SKYSENTRY_TLS_KEY)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", envDuration("SKYSENTRY_READ_HEADER_TIMEOUT", def.ReadHeaderTimeout), "time allowed to read request headers (env SKYSENTRY_READ_HEADER_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", envDuration("SKYSENTRY_IDLE_TIMEOUT", def.IdleTimeout), "close keep-alive connections idle this long (env SKYSENTRY_IDLE_TIMEOUT)")
+	fs.BoolVar(&cfg.HTTP2, "http2", envBool("SKYSENTRY_HTTP2", def.HTTP2), "offer HTTP/2 for REST and SSE when TLS is enabled (env SKYSENTRY_HTTP2)")
+	fs.StringVar(&cfg.RecordDir, "record-dir", envString("SKYSENTRY_RECORD_DIR", def.RecordDir), "record every frame to {dir}/{clientId}/ when set (env SKYSENTRY_RECORD_DIR)")
+	fs.Int64Var(&cfg.RecordMaxBytes, "record-max-bytes", envInt64("SKYSENTRY_RECORD_MAX_BYTES", def.RecordMaxBytes), "delete the oldest recordings beyond this many bytes, 0 for unlimited (env SKYSENTRY_RECORD_MAX_BYTES)")
+	fs.StringVar(&cfg.RecordMode, "record-mode", envString("SKYSENTRY_RECORD_MODE", def.RecordMode), `"all" records every frame, "motion" only motion events; needs -motion-threshold (env SKYSENTRY_RECORD_MODE)`)
+	fs.DurationVar(&cfg.RecordPreRoll, "record-pre-roll", envDuration("SKYSENTRY_RECORD_PRE_ROLL", def.RecordPreRoll), "in motion mode, also record this much footage from before motion started (env SKYSENTRY_RECORD_PRE_ROLL)")
+	fs.DurationVar(&cfg.RecordPostRoll, "record-post-roll", envDuration("SKYSENTRY_RECORD_POST_ROLL", def.RecordPostRoll), "in motion mode, keep recording this long after motion stops (env SKYSENTRY_RECORD_POST_ROLL)")
+	fs.DurationVar(&cfg.RecordSegmentDuration, "record-segment-duration", envDuration("SKYSENTRY_RECORD_SEGMENT_DURATION", def.RecordSegmentDuration), "split each client's recording into segment directories spanning this long, 0 never (env SKYSENTRY_RECORD_SEGMENT_DURATION)")
+	fs.Int64Var(&cfg.RecordSegmentBytes, "record-segment-bytes", envInt64("SKYSENTRY_RECORD_SEGMENT_BYTES", def.RecordSegmentBytes), "split each client's recording into segment directories of at most this many bytes, 0 for no limit (env SKYSENTRY_RECORD_SEGMENT_BYTES)")
+	fs.Float64Var(&cfg.MaxIngestFps, "max-ingest-fps", envFloat("SKYSENTRY_MAX_INGEST_FPS", def.MaxIngestFps), "frames per second accepted from each producer, 0 for unlimited, the default (env SKYSENTRY_MAX_INGEST_FPS)")
+	fs.Float64Var(&cfg.MessageRate, "max-message-rate", envFloat("SKYSENTRY_MAX_MESSAGE_RATE", def.MessageRate), "messages per second a producer or viewer connection may send before it is closed, 0 for unlimited (env SKYSENTRY_MAX_MESSAGE_RATE)")
+	fs.Float64Var(&cfg.APIRate, "api-rate", envFloat("SKYSENTRY_API_RATE", def.APIRate), "REST requests per second allowed from each remote IP before 429, 0 for unlimited, the default (env SKYSENTRY_API_RATE)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", envString("SKYSENTRY_ADMIN_TOKEN", def.AdminToken), "bearer token required by /api/admin endpoints, which are disabled when empty (env SKYSENTRY_ADMIN_TOKEN)")
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", envString("SKYSENTRY_WEBHOOK_URL", def.WebhookURL), "POST producer and viewer connect/disconnect events to this URL (env SKYSENTRY_WEBHOOK_URL)")
+	fs.Float64Var(&cfg.MotionThreshold, "motion-threshold", envFloat("SKYSENTRY_MOTION_THRESHOLD", def.MotionThreshold), "motion score (0-1) that alerts viewers, e.g. 0.1; motion detection decodes frames continuously, so it is off (0) by default (env SKYSENTRY_MOTION_THRESHOLD)")
+	fs.DurationVar(&cfg.MotionInterval, "motion-interval", envDuration("SKYSENTRY_MOTION_INTERVAL", def.MotionInterval), "how often each stream is sampled for motion (env SKYSENTRY_MOTION_INTERVAL)")
+	fs.StringVar(&cfg.LogFormat, "log-format", envString("SKYSENTRY_LOG_FORMAT", def.LogFormat), `log output: "json" for aggregators or "text" for local development (env SKYSENTRY_LOG_FORMAT)`)
+	fs.BoolVar(&cfg.AccessLog, "access-log", envBool("SKYSENTRY_ACCESS_LOG", def.AccessLog), "log method, path, status, size and latency of every /api request (env SKYSENTRY_ACCESS_LOG)")
+	level := fs.String("log-level", envString("SKYSENTRY_LOG_LEVEL", def.LogLevel.String()), "minimum log level: debug, info, warn or error (env SKYSENTRY_LOG_LEVEL)")
+	origins := fs.String("allowed-origins", envString("SKYSENTRY_ALLOWED_ORIGINS", ""), `comma-separated origins allowed to open WebSockets, e.g. "https://*.example.com"; "*" allows any (env SKYSENTRY_ALLOWED_ORIGINS)`)
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.AllowedOrigins = splitList(*origins)
+	if cfg.LogLevel, err = parseLogLevel(*level); err != nil {
+		return cfg, err
+	}
+	if _, err := newLogger(io.Discard, cfg.LogLevel, cfg.LogFormat); err != nil {
+		return cfg, err
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if cfg.BasePath, err = normalizeBasePath(cfg.BasePath); err != nil {
+		return cfg, err
+	}
+	switch cfg.DuplicateIDs {
+	case DUPLICATE_REJECT, DUPLICATE_SUFFIX, DUPLICATE_REPLACE:
+	default:
+		return cfg, fmt.Errorf("unknown -duplicate-ids %q, want %q, %q or %q", cfg.DuplicateIDs, DUPLICATE_REJECT, DUPLICATE_SUFFIX, DUPLICATE_REPLACE)
+	}
+	switch cfg.RecordMode {
+	case RECORD_MODE_ALL:
+	case RECORD_MODE_MOTION:
+		if cfg.MotionThreshold <= 0 {
+			return cfg, fmt.Errorf("-record-mode=motion needs motion detection, set -motion-threshold above 0")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown -record-mode %q, want %q or %q", cfg.RecordMode, RECORD_MODE_ALL, RECORD_MODE_MOTION)
+	}
+
+	if cfg.BufferSize < 1 {
+		cfg.BufferSize = def.BufferSize
+	}
+	if cfg.ReadHeaderTimeout <= 0 {
+		cfg.ReadHeaderTimeout = def.ReadHeaderTimeout
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = def.IdleTimeout
+	}
+	if cfg.MaxBufferSize < cfg.BufferSize {
+		cfg.MaxBufferSize = cfg.BufferSize
+	}
+	if cfg.ReconnectGrace < 0 {
+		cfg.ReconnectGrace = def.ReconnectGrace
+	}
+	if cfg.CoalesceWindow < 0 {
+		cfg.CoalesceWindow = def.CoalesceWindow
+	}
+	if cfg.NormalizeMaxWidth < 1 {
+		cfg.NormalizeMaxWidth = def.NormalizeMaxWidth
+	}
+	if cfg.NormalizeMaxHeight < 1 {
+		cfg.NormalizeMaxHeight = def.NormalizeMaxHeight
+	}
+	if cfg.NormalizeQuality < 1 || cfg.NormalizeQuality > 100 {
+		cfg.NormalizeQuality = def.NormalizeQuality
+	}
+	if cfg.NormalizeWorkers < 0 {
+		cfg.NormalizeWorkers = def.NormalizeWorkers
+	}
+	if cfg.MaxFrameSize < 1 {
+		cfg.MaxFrameSize = def.MaxFrameSize
+	}
+	if cfg.MaxDecodePixels < 1 {
+		cfg.MaxDecodePixels = def.MaxDecodePixels
+	}
+	if cfg.ViewerBuffer < 1 {
+		cfg.ViewerBuffer = def.ViewerBuffer
+	}
+	if cfg.ViewerWriteTimeout <= 0 {
+		cfg.ViewerWriteTimeout = def.ViewerWriteTimeout
+	}
+	if cfg.MessageRate < 0 {
+		cfg.MessageRate = def.MessageRate
+	}
+	if cfg.APIRate < 0 {
+		cfg.APIRate = def.APIRate
+	}
+	if cfg.MotionInterval <= 0 {
+		cfg.MotionInterval = def.MotionInterval
+	}
+	if cfg.RecordPreRoll < 0 {
+		cfg.RecordPreRoll = def.RecordPreRoll
+	}
+	if cfg.RecordPostRoll < 0 {
+		cfg.RecordPostRoll = def.RecordPostRoll
+	}
+	if cfg.RecordSegmentDuration < 0 {
+		cfg.RecordSegmentDuration = def.RecordSegmentDuration
+	}
+	if cfg.RecordSegmentBytes < 0 {
+		cfg.RecordSegmentBytes = def.RecordSegmentBytes
+	}
+	return cfg, nil
+}
+
+// TLSEnabled reports whether the server should listen with TLS.
+func (c Config) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// Addr returns the listen address, accepting either "8080" or ":8080".
+func (c Config) Addr() string {
+	if strings.Contains(c.Port, ":") {
+		return c.Port
+	}
+	return ":" + c.Port
+}
+
+// splitList parses a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("ignoring invalid environment variable", "key", key, "value", v, "err", err)
+		return def
+	}
+	return n
+}
+
+func envInt64(key string, def int64) int64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		slog.Warn("ignoring invalid environment variable", "key", key, "value", v, "err", err)
+		return def
+	}
+	return n
+}
+
+func envFloat(key string, def float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("ignoring invalid environment variable", "key", key, "value", v, "err", err)
+		return def
+	}
+	return f
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("ignoring invalid environment variable", "key", key, "value", v, "err", err)
+		return def
+	}
+	return d
+}
+
+func envBool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("ignoring invalid environment variable", "key", key, "value", v, "err", err)
+		return def
+	}
+	return b
+}
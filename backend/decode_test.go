@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// pngHeader returns a PNG signature and IHDR chunk declaring width×height,
+// with no image data after it.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 2 // 8-bit truecolor
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)-4))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+func TestDecodeImage(t *testing.T) {
+	data := testJPEG(t, 64, 48)
+	if img, format, err := decodeImage(data, 64*48); err != nil || format != "jpeg" || img.Bounds().Dx() != 64 {
+		t.Errorf("decodeImage at the limit = %v, %q, %v; want a 64px wide jpeg", img, format, err)
+	}
+	if _, _, err := decodeImage(data, 64*48-1); err != ErrImageTooLarge {
+		t.Errorf("decodeImage over the limit = %v, want %v", err, ErrImageTooLarge)
+	}
+	// A bare header claiming 100000×100000 is refused before any pixel
+	// buffer is allocated.
+	if _, _, err := decodeImage(pngHeader(100000, 100000), MAX_DECODE_PIXELS); err != ErrImageTooLarge {
+		t.Errorf("decodeImage of a huge PNG header = %v, want %v", err, ErrImageTooLarge)
+	}
+	if _, _, err := decodeImage(testFrame(64), MAX_DECODE_PIXELS); err == nil {
+		t.Error("decodeImage of garbage should fail")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Registering an ID that is connected elsewhere replaces the existing
+// client. That is right for a camera reconnecting over a half-open
+// connection, but two cameras configured with the same ID keep replacing
+// each other as both reconnect. Takeovers of one ID are counted, and past
+// DUPLICATE_TAKEOVERS within DUPLICATE_WINDOW the newcomer is handled
+// according to Config.DuplicateIDs.
+
+const (
+	DUPLICATE_WINDOW    = 30 * time.Second
+	DUPLICATE_TAKEOVERS = 3 // Takeovers within DUPLICATE_WINDOW that mean two producers share an ID
+
+	DUPLICATE_REJECT  = "reject"  // Refuse the newcomer; the connected producer keeps the ID
+	DUPLICATE_SUFFIX  = "suffix"  // Register the newcomer as "<id>-2", "<id>-3", ...
+	DUPLICATE_REPLACE = "replace" // Always let the newcomer take over
+)
+
+var ErrDuplicateClient = errors.New("client ID is in use by another producer")
+
+// takeoverTracker remembers recent takeovers per client ID.
+type takeoverTracker struct {
+	mutex     sync.Mutex
+	times     map[string][]time.Time
+	lastSweep time.Time
+}
+
+// record notes a takeover of id at now and returns how many happened within
+// DUPLICATE_WINDOW, including this one.
+func (t *takeoverTracker) record(id string, now time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.times == nil {
+		t.times = make(map[string][]time.Time)
+	}
+	if now.Sub(t.lastSweep) > DUPLICATE_WINDOW {
+		for key, times := range t.times {
+			if now.Sub(times[len(times)-1]) > DUPLICATE_WINDOW {
+				delete(t.times, key)
+			}
+		}
+		t.lastSweep = now
+	}
+	recent := t.times[id][:0]
+	for _, at := range t.times[id] {
+		if now.Sub(at) <= DUPLICATE_WINDOW {
+			recent = append(recent, at)
+		}
+	}
+	t.times[id] = append(recent, now)
+	return len(t.times[id])
+}
+
+// resolveDuplicate returns the ID a producer on conn asking for clientID
+// should register as, or ErrDuplicateClient. Attempts that are refused or
+// renamed still count, so a second camera retrying with backoff keeps the
+// ID marked as contested instead of eventually taking it over.
+func (ss *StreamServer) resolveDuplicate(clientID string, conn *websocket.Conn, remoteAddr string) (string, error) {
+	if ss.config.DuplicateIDs == DUPLICATE_REPLACE {
+		return clientID, nil
+	}
+	if existing, ok := ss.GetClient(clientID); !ok || existing.owns(conn) || !existing.Connected() {
+		return clientID, nil // Free, the same connection, or a producer reattaching
+	}
+	n := ss.takeovers.record(clientID, ss.clock.Now())
+	if n < DUPLICATE_TAKEOVERS {
+		return clientID, nil
+	}
+	if ss.config.DuplicateIDs == DUPLICATE_REJECT {
+		slog.Warn("rejected registration: client ID used by another producer", "event", "duplicate_client_id", "clientId", clientID, "remoteAddr", remoteAddr, "takeovers", n)
+		return "", ErrDuplicateClient
+	}
+	for i := 2; ; i++ {
+		suffix := fmt.Sprintf("-%d", i)
+		candidate := clientID[:min(len(clientID), MAX_CLIENT_ID_LENGTH-len(suffix))] + suffix
+		if _, taken := ss.GetClient(candidate); !taken {
+			slog.Warn("renamed registration: client ID used by another producer", "event", "duplicate_client_id", "clientId", clientID, "assignedId", candidate, "remoteAddr", remoteAddr, "takeovers", n)
+			return candidate, nil
+		}
+	}
+}
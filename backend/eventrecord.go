@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_MODE_ALL    = "all"    // Record every frame
+	RECORD_MODE_MOTION = "motion" // Record only around motion events
+
+	RECORD_PRE_ROLL  = 3 * time.Second // Default footage kept from before motion started
+	RECORD_POST_ROLL = 5 * time.Second // Default recording time after motion stops
+	RECORD_EVENTS    = "events"        // Subdirectory of a client's recording holding its events
+)
+
+// EventManifest describes one motion event, written to manifest.json in the
+// event's directory when the event starts and rewritten when it ends.
+type EventManifest struct {
+	ClientID   string     `json:"clientId"`
+	Start      time.Time  `json:"start"`         // First recorded frame, including pre-roll
+	Trigger    time.Time  `json:"trigger"`       // When motion crossed the threshold
+	End        *time.Time `json:"end,omitempty"` // Last recorded frame; absent while recording
+	Frames     int        `json:"frames"`
+	PeakMotion float64    `json:"peakMotion"`
+}
+
+// eventRecorder records a client's frames only around motion. Frames are
+// held for the pre-roll while nothing happens; when the motion detector
+// triggers, they are flushed to a new event directory and recording
+// continues until no motion has been seen for the post-roll. Frames share
+// their data with the ring buffer, so the pre-roll costs little memory.
+type eventRecorder struct {
+	rec      *Recorder
+	clientID string
+	preRoll  time.Duration
+	postRoll time.Duration
+
+	mutex   sync.Mutex
+	pending []*Frame       // Frames within the pre-roll, oldest first
+	event   *EventManifest // Current event, nil when idle
+	dir     string         // Current event's directory, relative to the client's
+	until   time.Time      // End of the post-roll
+}
+
+func newEventRecorder(rec *Recorder, clientID string, preRoll, postRoll time.Duration) *eventRecorder {
+	return &eventRecorder{rec: rec, clientID: clientID, preRoll: preRoll, postRoll: postRoll}
+}
+
+// add records frame if an event is in progress, or holds it for the
+// pre-roll. A frame arriving after the post-roll ends the event.
+func (er *eventRecorder) add(frame *Frame) {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+	if er.event != nil && frame.Timestamp.After(er.until) {
+		er.finish()
+	}
+	if er.event != nil {
+		er.write(frame)
+		return
+	}
+	er.pending = append(er.pending, frame)
+	cutoff := frame.Timestamp.Add(-er.preRoll)
+	drop := 0
+	for drop < len(er.pending) && er.pending[drop].Timestamp.Before(cutoff) {
+		drop++
+	}
+	er.pending = er.pending[drop:]
+}
+
+// trigger reports motion scoring score at the given time, starting an event
+// or extending the current one's post-roll.
+func (er *eventRecorder) trigger(at time.Time, score float64) {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+	er.until = at.Add(er.postRoll)
+	if er.event == nil {
+		er.event = &EventManifest{ClientID: er.clientID, Start: at, Trigger: at}
+		er.dir = path.Join(RECORD_EVENTS, at.UTC().Format(RECORD_TIME_NAME))
+		if len(er.pending) > 0 {
+			er.event.Start = er.pending[0].Timestamp
+		}
+		slog.Info("motion recording started", "event", "record_event_start", "clientId", er.clientID, "dir", er.dir)
+		er.rec.WriteManifest(er.clientID, er.dir, *er.event)
+		for _, frame := range er.pending {
+			er.write(frame)
+		}
+		er.pending = nil
+	}
+	er.event.PeakMotion = max(er.event.PeakMotion, score)
+}
+
+// close ends any event in progress, when the client goes away.
+func (er *eventRecorder) close() {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+	if er.event != nil {
+		er.finish()
+	}
+	er.pending = nil
+}
+
+// write records frame as part of the current event. Callers must hold mutex.
+func (er *eventRecorder) write(frame *Frame) {
+	er.rec.RecordEvent(er.clientID, er.dir, frame)
+	er.event.Frames++
+	end := frame.Timestamp
+	er.event.End = &end
+}
+
+// finish writes the final manifest of the current event. Callers must hold
+// mutex.
+func (er *eventRecorder) finish() {
+	if er.event.End == nil {
+		end := er.event.Trigger
+		er.event.End = &end
+	}
+	slog.Info("motion recording finished", "event", "record_event_end", "clientId", er.clientID, "dir", er.dir, "frames", er.event.Frames, "peakMotion", er.event.PeakMotion)
+	er.rec.WriteManifest(er.clientID, er.dir, *er.event)
+	er.event = nil
+}
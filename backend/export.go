@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const EXPORT_FRAMES = 30 // Default ?count= for zip exports
+
+// exportManifest is manifest.json in a zip export.
+type exportManifest struct {
+	ClientID   string          `json:"clientId"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Frames     []exportedFrame `json:"frames"` // Oldest first, in file order
+}
+
+type exportedFrame struct {
+	File        string    `json:"file"`
+	Seq         uint64    `json:"seq"`
+	Timestamp   time.Time `json:"timestamp"`
+	CaptureTime time.Time `json:"captureTime"`
+	Size        int       `json:"size"`
+	Format      string    `json:"format"`
+	Checksum    uint32    `json:"checksum"`
+}
+
+// handleExport streams the client's ?count= most recent buffered frames as
+// a zip of numbered images plus manifest.json, for bundling evidence.
+// Entries are written straight to the response and stored uncompressed,
+// since the images already are, so memory use doesn't grow with count.
+func (ss *StreamServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	count := EXPORT_FRAMES
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > ss.config.MaxBufferSize {
+			badRequest(w, fmt.Sprintf("count must be between 1 and %d", ss.config.MaxBufferSize))
+			return
+		}
+		count = n
+	}
+	frames := ss.unexpired(client.Buffer.GetLatestN(count))
+	if len(frames) == 0 {
+		noFrames(w)
+		return
+	}
+
+	now := ss.clock.Now()
+	ss.recordAccess(r, clientID, len(frames))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.zip"`, safePathComponent(clientID), now.UTC().Format("20060102T150405Z")))
+	w.Header().Set("Cache-Control", "no-store")
+
+	manifest := exportManifest{ClientID: clientID, ExportedAt: now}
+	zw := zip.NewWriter(w)
+	for i, frame := range frames {
+		name := fmt.Sprintf("frame-%04d.%s", i+1, fileExtension(frame.Format))
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: frame.Timestamp})
+		if err == nil {
+			_, err = f.Write(frame.Data)
+		}
+		if err != nil {
+			// Headers are sent; the truncated archive tells the client.
+			slog.Warn("zip export aborted", "event", "export_error", "clientId", clientID, "remoteAddr", r.RemoteAddr, "err", err)
+			return
+		}
+		manifest.Frames = append(manifest.Frames, exportedFrame{
+			File:        name,
+			Seq:         frame.Seq,
+			Timestamp:   frame.Timestamp,
+			CaptureTime: frame.CaptureTime,
+			Size:        frame.Size,
+			Format:      frame.Format,
+			Checksum:    frame.Checksum,
+		})
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: now})
+	if err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		slog.Warn("zip export aborted", "event", "export_error", "clientId", clientID, "remoteAddr", r.RemoteAddr, "err", err)
+	}
+}
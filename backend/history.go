@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	HISTORY_INTERVAL = time.Second // Time between stats samples
+	HISTORY_SIZE     = 300         // Samples kept per client (5 minutes)
+)
+
+// HistoryPoint is one stats sample for charting.
+type HistoryPoint struct {
+	Time        time.Time `json:"time"`
+	Fps         float64   `json:"fps"`
+	FrameSize   int       `json:"frameSize"` // Bytes in the latest frame
+	BytesPerSec float64   `json:"bytesPerSec"`
+}
+
+// statsHistory is a fixed-size ring of samples. It is not safe for
+// concurrent use; the owning client's mutex guards it.
+type statsHistory struct {
+	points []HistoryPoint
+	next   int
+	full   bool
+}
+
+func (h *statsHistory) add(p HistoryPoint) {
+	if h.points == nil {
+		h.points = make([]HistoryPoint, HISTORY_SIZE)
+	}
+	h.points[h.next] = p
+	h.next = (h.next + 1) % len(h.points)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the samples oldest first.
+func (h *statsHistory) list() []HistoryPoint {
+	if !h.full {
+		return append([]HistoryPoint(nil), h.points[:h.next]...)
+	}
+	return append(append([]HistoryPoint(nil), h.points[h.next:]...), h.points[:h.next]...)
+}
+
+// History returns the client's stats samples, oldest first.
+func (c *Client) History() []HistoryPoint {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.history.list()
+}
+
+// sampleHistory records every client's fps, frame size and byte rate each
+// HISTORY_INTERVAL. Rates drop to 0 for a client that has sent nothing
+// since the previous sample, rather than repeating its last estimate.
+func (ss *StreamServer) sampleHistory() {
+	ticker := time.NewTicker(HISTORY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case now := <-ticker.C:
+			ss.mutex.RLock()
+			clients := make([]*Client, 0, len(ss.clients))
+			for _, client := range ss.clients {
+				clients = append(clients, client)
+			}
+			ss.mutex.RUnlock()
+			for _, client := range clients {
+				client.sampleHistory(now)
+			}
+		}
+	}
+}
+
+func (c *Client) sampleHistory(now time.Time) {
+	point := HistoryPoint{Time: now}
+	if frame := c.Buffer.GetLatest(); frame != nil {
+		point.FrameSize = frame.Size
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.LastSeen) <= HISTORY_INTERVAL {
+		point.Fps, point.BytesPerSec = c.fps, c.bytesPerSec
+	}
+	c.history.add(point)
+}
+
+// handleGetHistory returns a client's recent stats samples, oldest first.
+func (ss *StreamServer) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clientId":   clientID,
+		"intervalMs": HISTORY_INTERVAL.Milliseconds(),
+		"points":     client.History(),
+	})
+}
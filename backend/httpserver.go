@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	READ_HEADER_TIMEOUT = 10 * time.Second  // Default time allowed to read request headers
+	IDLE_TIMEOUT        = 120 * time.Second // Default keep-alive idle timeout
+)
+
+// newHTTPServer builds the server for handler with the configured timeouts.
+//
+// Only the header read and keep-alive idle time are bounded. ReadTimeout and
+// WriteTimeout stay unset because SSE, MJPEG and playback responses stream
+// for as long as the viewer watches, and WebSocket connections manage their
+// own deadlines once upgraded.
+//
+// With TLS, net/http negotiates HTTP/2 for REST and SSE clients by default,
+// which lets a dashboard poll many cameras over one connection. WebSocket
+// upgrades still arrive on HTTP/1.1 connections, since browsers only use
+// HTTP/2 for WebSockets when the server offers extended CONNECT. Setting
+// HTTP2 to false restricts TLS to HTTP/1.1.
+func newHTTPServer(config Config, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	if !config.HTTP2 {
+		// A non-nil, empty map disables the automatic HTTP/2 setup.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return srv
+}
+
+// normalizeBasePath turns a -base-path value into the form routes are
+// mounted under: a leading slash and no trailing one, or "" for the root.
+func normalizeBasePath(base string) (string, error) {
+	if strings.ContainsAny(base, "?#{}") {
+		return "", fmt.Errorf("invalid -base-path %q: must be a plain URL path", base)
+	}
+	base = path.Clean("/" + strings.TrimSpace(base))
+	if base == "/" {
+		return "", nil
+	}
+	return base, nil
+}
+
+// mountRouter returns the router routes should be added to: root itself, or
+// a subrouter under base so every route, WebSockets included, is prefixed.
+func mountRouter(root *mux.Router, base string) *mux.Router {
+	if base == "" {
+		return root
+	}
+	return root.PathPrefix(base).Subrouter()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// KeyStore holds per-client producer keys. Keys can be replaced at runtime
+// through the admin API, so implementations must be safe for concurrent use.
+type KeyStore interface {
+	// Key returns clientID's key, if it has one.
+	Key(clientID string) (string, bool)
+	// SetKey stores a new key for clientID.
+	SetKey(clientID, key string) error
+}
+
+// newProducerKey returns a random key for key rotation.
+func newProducerKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// memoryKeyStore keeps keys in memory only; rotations are lost on restart.
+type memoryKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]string
+}
+
+// NewMemoryKeyStore returns a KeyStore holding a copy of keys.
+func NewMemoryKeyStore(keys map[string]string) KeyStore {
+	return newMemoryKeyStore(keys)
+}
+
+func newMemoryKeyStore(keys map[string]string) *memoryKeyStore {
+	store := &memoryKeyStore{keys: make(map[string]string, len(keys))}
+	for id, key := range keys {
+		store.keys[id] = key
+	}
+	return store
+}
+
+func (s *memoryKeyStore) Key(clientID string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	key, ok := s.keys[clientID]
+	return key, ok
+}
+
+func (s *memoryKeyStore) SetKey(clientID, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys[clientID] = key
+	return nil
+}
+
+// fileKeyStore is a memoryKeyStore that writes every change back to the
+// JSON file it was loaded from, so rotated keys survive a restart.
+type fileKeyStore struct {
+	*memoryKeyStore
+	path string
+}
+
+// NewFileKeyStore loads a JSON object mapping client IDs to their keys from
+// path, see LoadKeys.
+func NewFileKeyStore(path string) (KeyStore, error) {
+	keys, err := LoadKeys(path, "producer")
+	if err != nil {
+		return nil, err
+	}
+	return &fileKeyStore{memoryKeyStore: newMemoryKeyStore(keys), path: path}, nil
+}
+
+// SetKey updates the file before the in-memory key, so a key that fails to
+// persist is never accepted.
+func (s *fileKeyStore) SetKey(clientID, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make(map[string]string, len(s.keys)+1)
+	for id, k := range s.keys {
+		keys[id] = k
+	}
+	keys[clientID] = key
+	data, _ := json.MarshalIndent(keys, "", "  ")
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write producer keys: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("write producer keys: %w", err)
+	}
+	s.keys = keys
+	return nil
+}
@@ -1,32 +1,75 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"image"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	BUFFER_SIZE       = 32
+	MAX_BUFFER_SIZE   = 256 // Default cap on producer-requested buffer sizes
 	MAX_FRAME_SIZE    = 2 * 1024 * 1024
+	MAX_DECODE_PIXELS = 7680 * 4320 // Default cap on decoded frame dimensions, 8K UHD
 	CLEANUP_INTERVAL  = 60 * time.Second
 	CLIENT_TIMEOUT    = 5 * time.Minute
+	STALE_AFTER       = 10 * time.Second // Default age at which a stream is reported stale
 	MAX_BROADCAST_FPS = 60
+	SHUTDOWN_TIMEOUT  = 10 * time.Second
+	BROADCAST_QUEUE   = 8                     // Frames waiting for a client's broadcaster
+	VIEWER_BUFFER     = 2 * MAX_BROADCAST_FPS // Default messages queued per viewer: two seconds at full rate
+
+	WRITE_WAIT        = 10 * time.Second     // Time allowed to write a message to a peer
+	VIEWER_WRITE_WAIT = 2 * time.Second      // Default time allowed for each write to a viewer
+	PONG_WAIT         = 60 * time.Second     // Time allowed to read the next pong from a peer
+	PING_PERIOD       = (PONG_WAIT * 9) / 10 // Must be less than PONG_WAIT
+)
+
+var (
+	ErrUnknownClient    = errors.New("unknown client")
+	ErrFrameTooLarge    = errors.New("frame exceeds maximum size")
+	ErrUnknownFormat    = errors.New("frame is not a supported image format")
+	ErrFormatMismatch   = errors.New("frame does not match its declared format")
+	ErrServerFull       = errors.New("producer limit reached")
+	ErrTooManyViewers   = errors.New("viewer limit reached")
+	ErrRateLimited      = errors.New("frame exceeds the client's ingest rate")
+	ErrChecksumMismatch = errors.New("frame does not match its checksum")
+	ErrNormalizerBusy   = errors.New("normalizer queue is full")
+	ErrImageTooLarge    = errors.New("image dimensions exceed the decode limit")
 )
 
 // Frame represents a single webcam frame
 type Frame struct {
-	Data      []byte    `json:"data"`
-	Timestamp time.Time `json:"timestamp"`
-	Size      int       `json:"size"`
-	Format    string    `json:"format"`
+	Data        []byte    `json:"data"`
+	Timestamp   time.Time `json:"timestamp"`   // When the server received the frame
+	CaptureTime time.Time `json:"captureTime"` // When the camera captured it, as reported by the producer
+	Size        int       `json:"size"`
+	Format      string    `json:"format"`
+	Seq         uint64    `json:"seq"`      // 1-based position in the client's stream
+	Checksum    uint32    `json:"checksum"` // CRC-32 (IEEE) of Data, for delta mode and end-to-end verification
 }
 
 // RingBuffer is a circular buffer for frames
@@ -50,14 +93,17 @@ func (rb *RingBuffer) Add(frame *Frame) {
 	rb.mutex.Lock()
 	defer rb.mutex.Unlock()
 
+	rb.frameCount++
+	frame.Seq = rb.frameCount
 	rb.frames[rb.head] = frame
 	rb.head = (rb.head + 1) % rb.capacity
-	rb.frameCount++
 	if rb.size < rb.capacity {
 		rb.size++
 	}
 }
 
+// GetLatest returns a copy of the most recent frame, or nil if the buffer
+// is empty. The copy shares Data, which is never modified after Add.
 func (rb *RingBuffer) GetLatest() *Frame {
 	rb.mutex.RLock()
 	defer rb.mutex.RUnlock()
@@ -65,62 +111,595 @@ func (rb *RingBuffer) GetLatest() *Frame {
 		return nil
 	}
 	lastIndex := (rb.head - 1 + rb.capacity) % rb.capacity
-	return rb.frames[lastIndex]
+	frame := *rb.frames[lastIndex]
+	return &frame
+}
+
+// FrameCount returns the number of frames added since the buffer was created.
+func (rb *RingBuffer) FrameCount() uint64 {
+	rb.mutex.RLock()
+	defer rb.mutex.RUnlock()
+	return rb.frameCount
+}
+
+// GetLatestN returns up to n of the most recent frames, oldest first.
+func (rb *RingBuffer) GetLatestN(n int) []*Frame {
+	rb.mutex.RLock()
+	defer rb.mutex.RUnlock()
+	if n > rb.size {
+		n = rb.size
+	}
+	if n <= 0 {
+		return nil
+	}
+	frames := make([]*Frame, n)
+	for i := 0; i < n; i++ {
+		idx := (rb.head - n + i + rb.capacity) % rb.capacity
+		frames[i] = rb.frames[idx]
+	}
+	return frames
+}
+
+// Snapshot returns every stored frame, oldest first.
+func (rb *RingBuffer) Snapshot() []*Frame {
+	return rb.GetLatestN(rb.capacity)
+}
+
+// GetSince returns the buffered frames with a sequence number greater than
+// seq, oldest first. If seq is ahead of the buffer, the client's stream has
+// restarted and every buffered frame is returned.
+func (rb *RingBuffer) GetSince(seq uint64) []*Frame {
+	rb.mutex.RLock()
+	defer rb.mutex.RUnlock()
+	if seq > rb.frameCount {
+		seq = 0
+	}
+	n := min(rb.size, int(rb.frameCount-seq))
+	frames := make([]*Frame, n)
+	for i := 0; i < n; i++ {
+		frames[i] = rb.frames[(rb.head-n+i+rb.capacity)%rb.capacity]
+	}
+	return frames
+}
+
+// GetNearest returns a copy of the buffered frame whose timestamp is
+// closest to t, or nil if the buffer is empty.
+func (rb *RingBuffer) GetNearest(t time.Time) *Frame {
+	rb.mutex.RLock()
+	defer rb.mutex.RUnlock()
+	var nearest *Frame
+	var best time.Duration
+	for i := 0; i < rb.size; i++ {
+		frame := rb.frames[(rb.head-1-i+rb.capacity)%rb.capacity]
+		delta := frame.Timestamp.Sub(t)
+		if delta < 0 {
+			delta = -delta
+		}
+		if nearest == nil || delta < best {
+			nearest, best = frame, delta
+		}
+	}
+	if nearest == nil {
+		return nil
+	}
+	frame := *nearest
+	return &frame
+}
+
+// detectFormat identifies an image by its magic bytes, returning "jpeg",
+// "png" or "webp"; see supportedFormats.
+func detectFormat(data []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg", true
+	case bytes.HasPrefix(data, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}):
+		return "png", true
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "webp", true
+	}
+	return "", false
+}
+
+// decodeImage decodes frame data unless its header declares more than
+// maxPixels pixels. A few hundred bytes of header can claim any size, so
+// every decode of producer data goes through here rather than straight to
+// image.Decode, which would allocate the full image first.
+func decodeImage(data []byte, maxPixels int) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		return nil, "", ErrImageTooLarge
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// normalizeFormat maps a producer-declared format name onto the names used
+// by detectFormat. It returns "" for unsupported names.
+func normalizeFormat(format string) string {
+	switch strings.ToLower(format) {
+	case "jpeg", "jpg", "image/jpeg":
+		return "jpeg"
+	case "png", "image/png":
+		return "png"
+	case "webp", "image/webp":
+		return "webp"
+	}
+	return ""
+}
+
+// FrameOptions carries optional producer-supplied metadata for one frame.
+type FrameOptions struct {
+	Format      string    // Declared format; must agree with the detected one when set
+	CaptureTime time.Time // Producer capture time; the receive time is used when zero
+	Checksum    *uint32   // Producer CRC-32 of the frame, checked when the client verifies
+}
+
+// mimeType returns the Content-Type for a frame format.
+func mimeType(format string) string {
+	return "image/" + format
+}
+
+// dataURI encodes a frame for embedding in JSON messages.
+func dataURI(frame *Frame) string {
+	return fmt.Sprintf("data:%s;base64,%s", mimeType(frame.Format), base64.StdEncoding.EncodeToString(frame.Data))
 }
 
 // Client represents a connected webcam producer
 type Client struct {
-	ID         string
-	Buffer     *RingBuffer
-	LastSeen   time.Time
-	conn       *websocket.Conn
-	mutex      sync.RWMutex
-	timestamps []time.Time
-	fps        float64
+	ID          string
+	Buffer      *RingBuffer
+	LastSeen    time.Time
+	conn        *websocket.Conn
+	mutex       sync.RWMutex
+	window      rateWindow // Recent frames, for fps and bytesPerSec
+	fps         float64
+	bytesIn     uint64
+	bytesPerSec float64
+	limiter     *tokenBucket // Ingest cap, nil for unlimited
+	dropped     uint64       // Frames refused by limiter
+	backlogged  uint64       // Frames dropped because the client's normalizer worker fell behind
+	verify      bool         // Reject frames whose producer checksum doesn't match
+	normalize   bool         // Re-encode frames on the normalizer, see ingestFrame
+	corrupted   uint64       // Frames rejected by checksum verification
+	paused      bool         // Broadcasting suspended by an administrator; frames are still buffered
+	closed      bool         // Set once retired; AddFrame refuses frames for a closed client
+	detached    time.Time    // When the producer's connection was lost, zero while connected; see detachClient
+	motion      float64      // Latest motion score, see runMotionDetector
+	thumb       *thumbnail   // Most recent thumbnail, regenerated lazily
+	stream      bool         // Named stream; conn belongs to the producer's main client
+	staleAfter  time.Duration
+	clock       Clock
+	protocol    string // Negotiated subprotocol, see protocolVersion
+
+	Metadata map[string]string // Device description sent by the producer, guarded by mutex
+	history  statsHistory      // Periodic stats samples, see sampleHistory
+	events   *eventRecorder    // Motion-mode recording, nil when every frame is recorded
+
+	frameSizes     prometheus.Observer // This client's series of serverMetrics.frameSizes
+	frameIntervals prometheus.Observer // and of serverMetrics.frameIntervals
+
+	queue    chan *Frame   // Frames waiting to be broadcast, in arrival order
+	done     chan struct{} // Closed when the client is torn down
+	stopOnce sync.Once
+}
+
+// verifyChecksum reports whether a frame with CRC-32 sum may be accepted
+// given the checksum its producer sent, if any. Only clients registered with
+// verification check it; mismatches are counted as corrupted.
+func (c *Client) verifyChecksum(sum uint32, want *uint32) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.verify || want == nil || *want == sum {
+		return true
+	}
+	c.corrupted++
+	return false
+}
+
+// Paused reports whether an administrator has suspended broadcasting.
+func (c *Client) Paused() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.paused
+}
+
+// SetPaused suspends or resumes broadcasting and reports whether the state
+// changed.
+func (c *Client) SetPaused(paused bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	changed := c.paused != paused
+	c.paused = paused
+	return changed
+}
+
+// enqueue hands a frame to the client's broadcaster. When the queue is full
+// the oldest waiting frame is discarded so viewers stay close to live.
+func (c *Client) enqueue(frame *Frame) {
+	for {
+		select {
+		case c.queue <- frame:
+			return
+		default:
+		}
+		select {
+		case <-c.queue:
+		default:
+		}
+	}
+}
+
+// ClientStats is a consistent snapshot of a client's ingest counters.
+type ClientStats struct {
+	Fps         float64   `json:"fps"`
+	FrameCount  uint64    `json:"frameCount"`
+	BytesIn     uint64    `json:"bytesIn"`
+	BytesPerSec float64   `json:"bytesPerSec"`
+	Dropped     uint64    `json:"dropped"`   // Frames refused by the ingest rate limit
+	Corrupted   uint64    `json:"corrupted"` // Frames rejected by checksum verification
+	Paused      bool      `json:"paused"`    // Frames are buffered but not sent to viewers
+	Motion      float64   `json:"motion"`    // Difference between recent frames, 0 to 1
+	LastSeen    time.Time `json:"-"`
+
+	LastFrameAge float64 `json:"lastFrameAge"` // Seconds since the last frame (or registration)
+	Stale        bool    `json:"stale"`        // LastFrameAge exceeds the server's -stale-after
+
+	NormalizerDropped uint64 `json:"normalizerDropped"` // Frames dropped because the normalizer fell behind
+}
+
+// Stats returns the client's current counters, read under the client and
+// buffer locks.
+func (c *Client) Stats() ClientStats {
+	c.mutex.RLock()
+	stats := ClientStats{
+		Fps:         c.fps,
+		BytesIn:     c.bytesIn,
+		BytesPerSec: c.bytesPerSec,
+		Dropped:     c.dropped,
+		Corrupted:   c.corrupted,
+		Paused:      c.paused,
+		Motion:      c.motion,
+		LastSeen:    c.LastSeen,
+	}
+	stats.NormalizerDropped = c.backlogged
+	age := c.clock.Since(c.LastSeen)
+	c.mutex.RUnlock()
+	stats.LastFrameAge = age.Seconds()
+	stats.Stale = c.staleAfter > 0 && age > c.staleAfter
+	stats.FrameCount = c.Buffer.FrameCount()
+	return stats
+}
+
+// stop ends the client's broadcaster and closes its connection. A named
+// stream leaves the connection to its producer.
+func (c *Client) stop() {
+	c.retire()
+	if !c.stream {
+		c.connection().Close()
+	}
+}
+
+// retire ends the client's broadcaster and motion detector but leaves the
+// connection open, for a producer re-registering on the same connection.
+func (c *Client) retire() {
+	c.stopOnce.Do(func() {
+		c.mutex.Lock()
+		c.closed = true
+		c.mutex.Unlock()
+		close(c.done)
+	})
+}
+
+// owns reports whether conn is the connection this client registered on.
+func (c *Client) owns(conn *websocket.Conn) bool {
+	return c.connection() == conn
 }
 
 // StreamServer manages all clients and viewers
 type StreamServer struct {
-	clients    map[string]*Client
-	mutex      sync.RWMutex
-	upgrader   websocket.Upgrader
-	bufferSize int
+	clients  map[string]*Client
+	mutex    sync.RWMutex
+	upgrader websocket.Upgrader
+
+	viewerUpgrader websocket.Upgrader // Like upgrader, but negotiates compression when enabled
+	config         Config
+	audit          *AuditLog
+	metrics        *serverMetrics
+	normalizer     *normalizer
+	recorder       *Recorder
+	webhook        *Webhook
+
+	// authorizeProducer validates registration tokens on /ws. Nil disables
+	// producer authentication.
+	authorizeProducer TokenValidator
+	// producerKeys holds per-client producer keys for authorizeProducer and
+	// key rotation. Nil when producer authentication is disabled.
+	producerKeys KeyStore
+	// takeovers counts recent registrations that replaced a producer on
+	// another connection, see resolveDuplicate.
+	takeovers takeoverTracker
+	// authorizeViewer validates viewer tokens on /stream/ws and the frame
+	// endpoints. Nil leaves them public.
+	authorizeViewer TokenValidator
+
+	viewers      map[*Viewer]bool
+	viewersMutex sync.RWMutex
+
+	done      chan struct{} // Closed by Close to stop background goroutines
+	closeOnce sync.Once
+
+	clock     Clock
+	startTime time.Time
+	ready     atomic.Bool // Set once the listener is accepting connections
+	totals    serverTotals
 }
 
-func NewStreamServer(bufferSize int) *StreamServer {
-	return &StreamServer{
-		clients:    make(map[string]*Client),
-		bufferSize: bufferSize,
+// NewStreamServer creates a server for config. Options are applied after
+// the config, so they take precedence over it.
+func NewStreamServer(config Config, opts ...Option) *StreamServer {
+	ss := &StreamServer{
+		clients: make(map[string]*Client),
+		viewers: make(map[*Viewer]bool),
+		config:  config,
+		done:    make(chan struct{}),
+		clock:   systemClock{},
 		upgrader: websocket.Upgrader{
-			CheckOrigin:       func(r *http.Request) bool { return true },
+			CheckOrigin:       originChecker(config),
 			ReadBufferSize:    1024,
 			WriteBufferSize:   1024,
 			EnableCompression: false,
+			Subprotocols:      supportedProtocols,
 		},
 	}
+	for _, opt := range opts {
+		opt(ss)
+	}
+	ss.startTime = ss.clock.Now()
+	ss.viewerUpgrader = ss.upgrader
+	ss.viewerUpgrader.EnableCompression = ss.config.ViewerCompression
+	ss.metrics = newServerMetrics(ss)
+	ss.normalizer = newNormalizer(ss)
+	return ss
+}
+
+// originChecker returns the upgrader's CheckOrigin policy. With an
+// allowlist configured, browser origins must match one of its entries ("*"
+// allows everything). Without one, plain HTTP deployments accept any origin.
+// With TLS enabled, origins must also be served over HTTPS so a page on an
+// insecure origin cannot open a socket.
+func originChecker(config Config) func(r *http.Request) bool {
+	allowAll := len(config.AllowedOrigins) == 0
+	for _, pattern := range config.AllowedOrigins {
+		if pattern == "*" {
+			allowAll = true
+		}
+	}
+	if allowAll && !config.TLSEnabled() {
+		return func(r *http.Request) bool { return true }
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true // Non-browser clients don't send Origin
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		if config.TLSEnabled() && u.Scheme != "https" {
+			return false
+		}
+		if allowAll {
+			return true
+		}
+		for _, pattern := range config.AllowedOrigins {
+			if originMatches(pattern, u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// originMatches reports whether origin matches an allowlist entry such as
+// "https://app.example.com", "example.com:3000" or "https://*.example.com".
+// Entries without a scheme match any scheme; "*." matches any subdomain but
+// not the bare domain.
+func originMatches(pattern string, origin *url.URL) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if scheme != strings.ToLower(origin.Scheme) {
+			return false
+		}
+		pattern = rest
+	}
+	host := strings.ToLower(origin.Host)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
 }
 
-func (ss *StreamServer) AddClient(clientID string, conn *websocket.Conn) {
+// ClientOptions carries per-producer settings negotiated at registration.
+type ClientOptions struct {
+	MaxFps     float64 // Ingest cap, 0 for unlimited; see ingestRate
+	BufferSize int     // Ring buffer capacity, 0 for the server default; see bufferSize
+	Stream     bool    // Named stream sharing its producer's connection, see stream.go
+	Verify     bool    // Check producer-supplied frame checksums, see verifyChecksum
+	Normalize  bool    // Re-encode frames to the configured bounds, see normalize.go
+}
+
+// AddClient registers a producer, replacing any existing client with the
+// same ID. A replaced client on another connection has that connection
+// closed; its read loop then sees it no longer owns the ID and exits without
+// touching the new client. New IDs are refused with ErrServerFull once
+// MaxClients is reached.
+func (ss *StreamServer) AddClient(clientID string, conn *websocket.Conn, opts ClientOptions) error {
 	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = ss.config.BufferSize
+	}
+	paused := false
 	if existing, ok := ss.clients[clientID]; ok {
-		existing.conn.Close()
+		if existing.canReattach(opts, bufferSize) {
+			existing.reattach(conn, opts)
+			ss.mutex.Unlock()
+			slog.Info("client reattached", "event", "client_reattached", "clientId", clientID, "frameCount", existing.Buffer.FrameCount())
+			return nil
+		}
+		paused = existing.Paused() // A reconnecting camera stays paused
+		if existing.owns(conn) {
+			existing.retire()
+		} else {
+			existing.stop()
+		}
+	} else if ss.config.MaxClients > 0 && len(ss.clients) >= ss.config.MaxClients {
+		ss.mutex.Unlock()
+		return ErrServerFull
+	} else {
+		ss.totals.clientsSeen.Add(1)
 	}
-	ss.clients[clientID] = &Client{
-		ID:         clientID,
-		Buffer:     NewRingBuffer(ss.bufferSize),
-		LastSeen:   time.Now(),
-		conn:       conn,
-		timestamps: make([]time.Time, 0, 10),
+	client := &Client{
+		ID:       clientID,
+		Buffer:   NewRingBuffer(bufferSize),
+		LastSeen: ss.clock.Now(),
+		conn:     conn,
+		clock:    ss.clock,
+		protocol: protocolVersion(conn),
+		queue:    make(chan *Frame, BROADCAST_QUEUE),
+		done:     make(chan struct{}),
+		stream:   opts.Stream,
+		verify:   opts.Verify,
+		paused:   paused,
+
+		staleAfter: ss.config.StaleAfter,
+		normalize:  opts.Normalize,
+
+		frameSizes:     ss.metrics.frameSizes.WithLabelValues(clientID),
+		frameIntervals: ss.metrics.frameIntervals.WithLabelValues(clientID),
+	}
+	if opts.MaxFps > 0 {
+		client.limiter = newTokenBucket(opts.MaxFps)
+	}
+	if ss.config.RecordMode == RECORD_MODE_MOTION && ss.recorder != nil {
+		client.events = newEventRecorder(ss.recorder, clientID, ss.config.RecordPreRoll, ss.config.RecordPostRoll)
+	}
+	ss.clients[clientID] = client
+	ss.mutex.Unlock()
+	go ss.runBroadcaster(client)
+	if ss.config.MotionThreshold > 0 {
+		go ss.runMotionDetector(client)
+	}
+	ss.notify("client_connected", clientID, "")
+	ss.announceClient("client-connected", clientID, "")
+	return nil
+}
+
+// ingestRate returns the ingest cap for a producer that asked for requested
+// frames per second. Producers may lower the server's MaxIngestFps but not
+// raise it; 0 means unlimited.
+func (ss *StreamServer) ingestRate(requested float64) float64 {
+	limit := ss.config.MaxIngestFps
+	if requested > 0 && (limit <= 0 || requested < limit) {
+		return requested
+	}
+	return max(limit, 0)
+}
+
+// bufferSize returns the ring buffer capacity for a producer that asked for
+// requested frames, clamped to MaxBufferSize. 0 selects the default.
+// Live-only producers, or all of them with -live-only, keep just the
+// latest frame.
+func (ss *StreamServer) bufferSize(requested int, liveOnly bool) int {
+	if liveOnly || ss.config.LiveOnly {
+		return 1
+	}
+	if requested <= 0 {
+		return ss.config.BufferSize
+	}
+	return min(requested, ss.config.MaxBufferSize)
+}
+
+// runBroadcaster delivers a client's frames to viewers one at a time until
+// the client is stopped, so frames reach viewers in the order they arrived.
+//
+// With a CoalesceWindow, a frame starts a timer instead of being sent, and
+// frames arriving before it fires replace it; only the newest is broadcast.
+// A producer catching up after a stall then sends viewers one frame rather
+// than a burst of near-identical ones, at the cost of up to one window of
+// added latency. The ring buffer and recordings still get every frame.
+func (ss *StreamServer) runBroadcaster(client *Client) {
+	var (
+		pending *Frame
+		timer   *time.Timer
+		fire    <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-client.done:
+			return
+		case frame := <-client.queue:
+			if ss.config.CoalesceWindow <= 0 {
+				ss.broadcastFrame(client, frame)
+				continue
+			}
+			if pending == nil {
+				timer = time.NewTimer(ss.config.CoalesceWindow)
+				fire = timer.C
+			}
+			pending = frame
+		case <-fire:
+			ss.broadcastFrame(client, pending)
+			pending, fire = nil, nil
+		}
 	}
 }
 
 func (ss *StreamServer) RemoveClient(clientID string) {
+	ss.removeClientConn(clientID, nil)
+}
+
+// removeClientConn removes clientID if it is still registered on conn (any
+// connection when conn is nil) and reports whether it did. A producer's read
+// loop uses it so it never removes a client that was already kicked or has
+// re-registered on another connection.
+func (ss *StreamServer) removeClientConn(clientID string, conn *websocket.Conn) bool {
 	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
-	if client, ok := ss.clients[clientID]; ok {
-		client.conn.Close()
+	client, ok := ss.clients[clientID]
+	if ok && (conn == nil || client.owns(conn)) {
+		client.stop()
 		delete(ss.clients, clientID)
+	} else {
+		ok = false
+	}
+	ss.mutex.Unlock()
+	if ok {
+		ss.forgetClient(client)
+		ss.notify("client_disconnected", clientID, "")
+		ss.announceClient("client-disconnected", clientID, "disconnected")
+	}
+	return ok
+}
+
+// forgetClient releases what the server keeps per client ID once client
+// has been removed. In motion recording mode the recorder's writer is left
+// for runMotionDetector, which still has an event manifest to write.
+// Metric series are kept if the ID has already been registered again.
+func (ss *StreamServer) forgetClient(client *Client) {
+	if client.events == nil {
+		ss.recorder.StopClient(client.ID)
+	}
+	if _, ok := ss.GetClient(client.ID); !ok {
+		ss.metrics.frameSizes.DeleteLabelValues(client.ID)
+		ss.metrics.frameIntervals.DeleteLabelValues(client.ID)
 	}
 }
 
@@ -131,113 +710,177 @@ func (ss *StreamServer) GetClient(clientID string) (*Client, bool) {
 	return client, ok
 }
 
-func (ss *StreamServer) AddFrame(clientID string, frameData []byte) {
+func (ss *StreamServer) AddFrame(clientID string, frameData []byte, opts FrameOptions) error {
+	format, errs := ss.checkFrame(frameData, opts)
+	if len(errs) > 0 {
+		return errs[0]
+	}
 	client, ok := ss.GetClient(clientID)
 	if !ok {
-		return
+		return ErrUnknownClient
+	}
+	checksum := crc32.ChecksumIEEE(frameData)
+	if !client.verifyChecksum(checksum, opts.Checksum) {
+		return ErrChecksumMismatch
 	}
+	now := ss.clock.Now()
 	frame := &Frame{
-		Data:      frameData,
-		Timestamp: time.Now(),
-		Size:      len(frameData),
-		Format:    "jpeg",
+		Data:        frameData,
+		Timestamp:   now,
+		CaptureTime: opts.CaptureTime,
+		Size:        len(frameData),
+		Format:      format,
+		Checksum:    checksum,
 	}
-	client.Buffer.Add(frame)
+	if frame.CaptureTime.IsZero() {
+		frame.CaptureTime = now
+	}
+
+	// The client may be removed at any point after GetClient. Holding its
+	// lock from the closed check until the frame is queued means retire
+	// either waits for this frame or the frame is refused, so nothing is
+	// buffered, recorded or broadcast for a client that is torn down.
 	client.mutex.Lock()
-	client.LastSeen = frame.Timestamp
-	client.timestamps = append(client.timestamps, frame.Timestamp)
-	if len(client.timestamps) > 10 {
-		client.timestamps = client.timestamps[1:]
+	defer client.mutex.Unlock()
+	if client.closed {
+		return ErrUnknownClient
 	}
-	if len(client.timestamps) > 1 {
-		intervals := make([]time.Duration, 0, len(client.timestamps)-1)
-		for i := 1; i < len(client.timestamps); i++ {
-			intervals = append(intervals, client.timestamps[i].Sub(client.timestamps[i-1]))
-		}
-		avgInterval := 0.0
-		for _, d := range intervals {
-			avgInterval += d.Seconds()
-		}
-		avgInterval /= float64(len(intervals))
-		client.fps = 1.0 / avgInterval
+	if client.limiter != nil && !client.limiter.allow(now) {
+		client.dropped++
+		return ErrRateLimited
+	}
+	prev := client.Buffer.GetLatest()
+	client.Buffer.Add(frame)
+	client.frameSizes.Observe(float64(frame.Size))
+	if prev != nil {
+		client.frameIntervals.Observe(frame.Timestamp.Sub(prev.Timestamp).Seconds())
+	}
+	if client.events != nil {
+		client.events.add(frame)
 	} else {
-		client.fps = 0
+		ss.recorder.Record(clientID, frame)
 	}
-	client.mutex.Unlock()
-
-	go ss.broadcastFrame(clientID, frame)
-}
+	client.LastSeen = frame.Timestamp
+	client.bytesIn += uint64(frame.Size)
+	client.window.add(frame.Timestamp, frame.Size)
+	fps, bytesPerSec := client.window.rates()
+	client.fps = smoothRate(client.fps, fps)
+	client.bytesPerSec = smoothRate(client.bytesPerSec, bytesPerSec)
 
-// Viewer represents a subscribed client with a buffered channel for non-blocking sends.
-type Viewer struct {
-	conn *websocket.Conn
-	send chan []byte // Buffered channel for outgoing messages
+	ss.totals.framesReceived.Add(1)
+	ss.totals.bytesReceived.Add(uint64(frame.Size))
+	client.enqueue(frame)
+	return nil
 }
 
-var viewers = make(map[*Viewer]bool)
-var viewersMutex sync.RWMutex
-
-// broadcastFrame sends a frame to all subscribed viewers using non-blocking channel sends.
-func (ss *StreamServer) broadcastFrame(clientID string, frame *Frame) {
-	viewersMutex.RLock()
-	defer viewersMutex.RUnlock()
-
-	if len(viewers) == 0 {
-		return
-	}
-
-	client, ok := ss.GetClient(clientID)
-	if !ok {
-		return
-	}
-
-	msg := map[string]interface{}{
-		"type":      "frame_update",
-		"clientId":  clientID,
-		"image":     fmt.Sprintf("data:image/jpeg;base64,%s", base64.StdEncoding.EncodeToString(frame.Data)),
-		"timestamp": frame.Timestamp,
-		"size":      frame.Size,
-		"stats":     map[string]interface{}{"frameCount": client.Buffer.frameCount, "fps": client.fps},
+func (ss *StreamServer) cleanupInactiveClients() {
+	interval := ss.config.CleanupInterval
+	if grace := ss.config.ReconnectGrace; grace > 0 {
+		interval = min(interval, grace) // Don't keep detached clients much past their grace
 	}
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ticker.C:
+		}
+		ss.removeInactiveClients()
+		ss.removeExpiredDetached()
 	}
+}
 
-	for viewer := range viewers {
-		select {
-		case viewer.send <- data:
-		// Message sent successfully (or buffered).
-		default:
-			// Channel is full. Client is too slow. Drop the frame.
-			log.Printf("Dropping frame for slow viewer. Connection: %s", viewer.conn.RemoteAddr())
+// removeInactiveClients removes producers that have been silent for longer
+// than ClientTimeout and returns their IDs.
+func (ss *StreamServer) removeInactiveClients() []string {
+	var removed []*Client
+	ss.mutex.Lock()
+	for id, client := range ss.clients {
+		if ss.clock.Since(client.Stats().LastSeen) > ss.config.ClientTimeout {
+			delete(ss.clients, id)
+			client.stop()
+			removed = append(removed, client)
+			slog.Info("cleaned up inactive client", "event", "client_cleanup", "clientId", id)
 		}
 	}
+	ss.mutex.Unlock()
+	ids := make([]string, len(removed))
+	for i, client := range removed {
+		ids[i] = client.ID
+		ss.forgetClient(client)
+		ss.notify("client_disconnected", client.ID, "")
+		ss.announceClient("client-disconnected", client.ID, "timeout")
+	}
+	return ids
 }
 
-func (ss *StreamServer) cleanupInactiveClients() {
-	ticker := time.NewTicker(CLEANUP_INTERVAL)
-	defer ticker.Stop()
-	for range ticker.C {
+// Close stops background goroutines and disconnects every producer and
+// viewer. It is safe to call more than once.
+func (ss *StreamServer) Close() {
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		deadline := time.Now().Add(time.Second)
+
 		ss.mutex.Lock()
 		for id, client := range ss.clients {
-			if time.Since(client.LastSeen) > CLIENT_TIMEOUT {
-				delete(ss.clients, id)
-				client.conn.Close()
-				log.Printf("Cleaned up inactive client: %s", id)
-			}
+			client.connection().WriteControl(websocket.CloseMessage, closeMsg, deadline)
+			client.stop()
+			delete(ss.clients, id)
 		}
 		ss.mutex.Unlock()
-	}
+
+		ss.viewersMutex.RLock()
+		for viewer := range ss.viewers {
+			if viewer.conn == nil {
+				continue // SSE viewers end when ss.done closes
+			}
+			viewer.conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+			viewer.conn.Close()
+		}
+		ss.viewersMutex.RUnlock()
+	})
 }
 
 // HTTP Handlers
-func corsMiddleware(next http.Handler) http.Handler {
+
+// corsMiddleware applies the AllowedOrigins allowlist to REST requests.
+// Without an allowlist, or with "*" in it, any origin may read responses
+// but without credentials. Otherwise a matching Origin is echoed back with
+// credentials allowed, and other origins get no CORS headers at all, so the
+// browser blocks them.
+func corsMiddleware(config Config) func(http.Handler) http.Handler {
+	allowAll := len(config.AllowedOrigins) == 0
+	for _, pattern := range config.AllowedOrigins {
+		if pattern == "*" {
+			allowAll = true
+		}
+	}
+	allowed := originChecker(config)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			switch {
+			case allowAll:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case origin != "" && allowed(r):
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Add("Vary", "Origin")
+			corsHeaders(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// corsHeaders answers preflight requests and lists the allowed methods and
+// headers; corsMiddleware decides which origins see them.
+func corsHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -246,131 +889,848 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// producerMessage is a control message sent by a producer over /ws.
+type producerMessage struct {
+	Type     string  `json:"type"`
+	ClientID string  `json:"clientId"`
+	Token    string  `json:"token"`
+	Format   string  `json:"format"`
+	MaxFps   float64 `json:"maxFps"`
+
+	BufferSize  int     `json:"bufferSize"`      // Registration only
+	LiveOnly    bool    `json:"liveOnly"`        // Registration only, see bufferSize
+	Batch       bool    `json:"batch"`           // Registration only, see batch.go
+	Verify      bool    `json:"verifyChecksums"` // Registration only, see verifyChecksum
+	Normalize   bool    `json:"normalize"`       // Registration only, see normalize.go
+	Checksum    *uint32 `json:"checksum"`        // CRC-32 of the next binary message, frame-meta only
+	CaptureTime int64   `json:"captureTime"`     // Unix milliseconds, frame-meta only
+	StreamID    string  `json:"streamId"`        // Named stream for the next frame, see stream.go
+
+	// Device description, metadata messages only
+	Resolution string `json:"resolution"`
+	Device     string `json:"device"`
+	Location   string `json:"location"`
+}
+
 func (ss *StreamServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := ss.upgrader.Upgrade(w, r, nil)
+	conn, err := upgrade(&ss.upgrader, w, r)
 	if err != nil {
 		return
 	}
+	conn.SetReadLimit(int64(ss.config.MaxFrameSize))
 	var clientID string
 	var registered bool
+	var batch bool           // Batched frames negotiated at registration
+	var defaultFormat string // Format declared at registration
+	var clientOpts ClientOptions
+	var pending *FrameOptions        // Metadata for the next binary frame
+	var pendingStream string         // Named stream for the next binary frame
+	streams := make(map[string]bool) // Named streams registered on this connection
+	releaseStreams := func(remove func(string, *websocket.Conn) bool) {
+		for key := range streams {
+			if remove(key, conn) {
+				slog.Info("stream disconnected", "event", "client_disconnected", "clientId", key, "remoteAddr", r.RemoteAddr)
+			}
+			delete(streams, key)
+		}
+	}
+	stopPing := make(chan struct{})
 	defer func() {
-		if registered {
-			ss.RemoveClient(clientID)
+		close(stopPing)
+		releaseStreams(ss.detachClient)
+		if registered && ss.detachClient(clientID, conn) {
+			slog.Info("client disconnected", "event", "client_disconnected", "clientId", clientID, "remoteAddr", r.RemoteAddr)
 		}
 		conn.Close()
 	}()
 
+	// Any message or pong proves the producer is alive; a half-open
+	// connection hits the read deadline within PONG_WAIT.
+	conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
+		return nil
+	})
+	go pingLoop(conn, stopPing)
+
+	limiter := newMessageLimiter(ss.config.MessageRate)
 	for {
 		msgType, data, err := conn.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			slog.Warn("disconnecting client: message too large", "event", "frame_oversized", "clientId", clientID, "remoteAddr", r.RemoteAddr, "limit", ss.config.MaxFrameSize)
+			break
+		}
 		if err != nil {
 			break
 		}
+		if !limiter.allow() {
+			slog.Warn("disconnecting client: message rate exceeded", "event", "message_rate_exceeded", "clientId", clientID, "remoteAddr", r.RemoteAddr, "limit", ss.config.MessageRate)
+			closePolicyViolation(conn, "message rate exceeded")
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
 		if msgType == websocket.TextMessage {
-			var msg map[string]string
-			if json.Unmarshal(data, &msg) == nil && msg["type"] == "client-registration" {
-				clientID = msg["clientId"]
-				ss.AddClient(clientID, conn)
+			var msg producerMessage
+			if err := decodeMessage(data, &msg); err != nil {
+				conn.WriteJSON(newProtocolError("malformed-message", err.Error()))
+				continue
+			}
+			switch msg.Type {
+			case "client-registration":
+				if !validClientID(msg.ClientID) {
+					slog.Warn("rejected registration: invalid client ID", "event", "registration_rejected", "clientId", msg.ClientID, "remoteAddr", r.RemoteAddr, "reason", "invalid-client-id")
+					conn.WriteJSON(map[string]string{
+						"type":   "registration-failed",
+						"reason": "invalid-client-id",
+						"detail": "clientId must be 1-64 letters, digits, '.', '-' or '_' and not start with '.'",
+					})
+					return
+				}
+				if ss.authorizeProducer != nil {
+					if _, ok := ss.authorizeProducer(msg.ClientID, msg.Token); !ok {
+						slog.Warn("rejected registration: invalid token", "event", "registration_rejected", "clientId", msg.ClientID, "remoteAddr", r.RemoteAddr, "reason", "unauthorized")
+						conn.WriteJSON(map[string]string{"type": "registration-failed", "reason": "unauthorized"})
+						return
+					}
+				}
+				id, err := ss.resolveDuplicate(msg.ClientID, conn, r.RemoteAddr)
+				if err == ErrDuplicateClient {
+					ss.rejectWebSocket(conn, "registration-failed", "duplicate-client-id")
+					return
+				}
+				if registered && id != clientID {
+					// Renamed; release the old ID and its streams
+					releaseStreams(ss.removeClientConn)
+					ss.removeClientConn(clientID, conn)
+				}
+				opts := ClientOptions{
+					MaxFps:     ss.ingestRate(msg.MaxFps),
+					BufferSize: ss.bufferSize(msg.BufferSize, msg.LiveOnly),
+					Verify:     msg.Verify,
+					Normalize:  msg.Normalize,
+				}
+				if err := ss.AddClient(id, conn, opts); err == ErrServerFull {
+					slog.Warn("rejected registration: server full", "event", "registration_rejected", "clientId", msg.ClientID, "remoteAddr", r.RemoteAddr, "reason", "server-full")
+					ss.rejectWebSocket(conn, "registration-failed", "server-full")
+					return
+				}
+				clientID = id
+				clientOpts = opts
+				batch = msg.Batch
+				if batch {
+					conn.SetReadLimit(int64(ss.config.MaxFrameSize) * BATCH_READ_FACTOR)
+				} else {
+					conn.SetReadLimit(int64(ss.config.MaxFrameSize))
+				}
+				defaultFormat = normalizeFormat(msg.Format)
 				registered = true
-				conn.WriteJSON(map[string]string{"type": "registration-success", "clientId": clientID})
+				slog.Info("client registered", "event", "client_registered", "clientId", clientID, "remoteAddr", r.RemoteAddr, "format", defaultFormat, "maxFps", opts.MaxFps, "bufferSize", opts.BufferSize, "protocol", protocolVersion(conn))
+				ack := map[string]interface{}{"type": "registration-success", "clientId": clientID, "bufferSize": opts.BufferSize, "protocol": protocolVersion(conn)}
+				if id != msg.ClientID {
+					ack["requestedClientId"] = msg.ClientID
+				}
+				if opts.BufferSize == 1 {
+					ack["liveOnly"] = true
+				}
+				if batch {
+					ack["batch"] = true
+					ack["maxBatchFrames"] = MAX_BATCH_FRAMES
+				}
+				if opts.MaxFps > 0 {
+					ack["maxFps"] = opts.MaxFps
+				}
+				if opts.Normalize {
+					ack["normalize"] = map[string]int{
+						"maxWidth":  ss.config.NormalizeMaxWidth,
+						"maxHeight": ss.config.NormalizeMaxHeight,
+						"quality":   ss.config.NormalizeQuality,
+					}
+				}
+				ack["capabilities"] = ss.producerCapabilities(opts, batch)
+				conn.WriteJSON(ack)
+			case "frame-meta":
+				if !registered {
+					conn.WriteJSON(newProtocolError("not-registered", "send client-registration first"))
+					continue
+				}
+				if msg.StreamID != "" && !validStreamID(msg.StreamID) {
+					conn.WriteJSON(newProtocolError("invalid-stream-id", "streamId must be 1-32 letters, digits, '-' or '_'"))
+					continue
+				}
+				pending = &FrameOptions{Format: normalizeFormat(msg.Format)}
+				if msg.CaptureTime > 0 {
+					pending.CaptureTime = time.UnixMilli(msg.CaptureTime)
+				}
+				pending.Checksum = msg.Checksum
+				pendingStream = msg.StreamID
+			case "metadata":
+				if !registered {
+					conn.WriteJSON(newProtocolError("not-registered", "send client-registration first"))
+					continue
+				}
+				fields, problem := metadataFields(msg)
+				if problem != nil {
+					conn.WriteJSON(problem)
+					continue
+				}
+				if client, ok := ss.GetClient(clientID); ok && client.owns(conn) {
+					ss.updateMetadata(client, fields)
+				}
+			default:
+				conn.WriteJSON(newProtocolError("unknown-message-type", msg.Type))
+			}
+		} else if msgType == websocket.BinaryMessage && !registered {
+			conn.WriteJSON(newProtocolError("not-registered", "send client-registration first"))
+		} else if msgType == websocket.BinaryMessage {
+			opts := FrameOptions{Format: defaultFormat}
+			if pending != nil {
+				if pending.Format != "" {
+					opts.Format = pending.Format
+				}
+				opts.CaptureTime = pending.CaptureTime
+				opts.Checksum = pending.Checksum
+				pending = nil
+			}
+			if client, ok := ss.GetClient(clientID); !ok || !client.owns(conn) {
+				// Kicked or replaced by a newer connection for this ID; don't
+				// let a stale frame land in the new client's buffer.
+				slog.Info("dropping superseded producer connection", "event", "client_superseded", "clientId", clientID, "remoteAddr", r.RemoteAddr)
+				return
+			}
+			key := clientID
+			if pendingStream != "" {
+				streamID := pendingStream
+				pendingStream = ""
+				if !validStreamID(streamID) {
+					slog.Warn("rejected frame: invalid stream ID", "event", "frame_rejected", "clientId", clientID, "remoteAddr", r.RemoteAddr, "streamId", streamID)
+					continue
+				}
+				key = streamKey(clientID, streamID)
+				if client, ok := ss.GetClient(key); !ok || !client.owns(conn) {
+					// First frame on this stream, or it was swept as idle.
+					streamOpts := clientOpts
+					streamOpts.Stream = true
+					if err := ss.AddClient(key, conn, streamOpts); err == ErrServerFull {
+						slog.Warn("rejected stream: server full", "event", "registration_rejected", "clientId", key, "remoteAddr", r.RemoteAddr, "reason", "server-full")
+						continue
+					}
+					streams[key] = true
+					slog.Info("stream registered", "event", "client_registered", "clientId", key, "remoteAddr", r.RemoteAddr)
+				}
+			}
+			frames := [][]byte{data}
+			if batch && isBatch(data) {
+				// A checksum covers the whole batch message.
+				if client, ok := ss.GetClient(key); ok && !client.verifyChecksum(crc32.ChecksumIEEE(data), opts.Checksum) {
+					slog.Warn("rejected batch: checksum mismatch", "event", "frame_corrupted", "clientId", key, "remoteAddr", r.RemoteAddr, "size", len(data))
+					conn.WriteJSON(newProtocolError("checksum-mismatch", "batch does not match its checksum"))
+					continue
+				}
+				opts.Checksum = nil
+				// frame-meta before a batch applies to every frame in it.
+				if frames, err = parseBatch(data, ss.config.MaxFrameSize); err != nil {
+					slog.Warn("rejected batch", "event", "frame_rejected", "clientId", key, "remoteAddr", r.RemoteAddr, "size", len(data), "err", err)
+					conn.WriteJSON(newProtocolError("malformed-batch", err.Error()))
+					continue
+				}
+			}
+			for _, frame := range frames {
+				switch err := ss.ingestFrame(key, frame, opts); err {
+				case ErrFrameTooLarge:
+					slog.Warn("rejected oversized frame", "event", "frame_oversized", "clientId", key, "remoteAddr", r.RemoteAddr, "size", len(frame))
+				case ErrUnknownFormat:
+					slog.Warn("rejected frame: unrecognized image format", "event", "frame_rejected", "clientId", key, "remoteAddr", r.RemoteAddr)
+				case ErrFormatMismatch:
+					slog.Warn("rejected frame: format mismatch", "event", "frame_rejected", "clientId", key, "remoteAddr", r.RemoteAddr, "format", opts.Format)
+				case ErrRateLimited, ErrNormalizerBusy:
+					// Counted in the client's stats; logging each one would flood the log.
+				case ErrChecksumMismatch:
+					slog.Warn("rejected frame: checksum mismatch", "event", "frame_corrupted", "clientId", key, "remoteAddr", r.RemoteAddr, "size", len(frame))
+					conn.WriteJSON(newProtocolError("checksum-mismatch", "frame does not match its checksum"))
+				}
 			}
-		} else if msgType == websocket.BinaryMessage && registered {
-			ss.AddFrame(clientID, data)
 		}
 	}
 }
 
-// writePump pumps messages from the channel to the websocket connection.
-func (v *Viewer) writePump() {
-	defer func() {
-		v.conn.Close()
-	}()
+// pingLoop pings conn every PING_PERIOD until stop is closed. It uses
+// WriteControl, which is safe alongside the connection's other writer.
+func pingLoop(conn *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(PING_PERIOD)
+	defer ticker.Stop()
 	for {
-		message, ok := <-v.send
-		if !ok {
-			// The channel has been closed.
-			v.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		select {
+		case <-stop:
 			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WRITE_WAIT)); err != nil {
+				return
+			}
 		}
-		v.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if err := v.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			return
+	}
+}
+
+// clientSummary is one entry of GET /api/clients?detail=true.
+type clientSummary struct {
+	ClientID string `json:"clientId"`
+	ClientStats
+	LastSeen  time.Time `json:"lastSeen"`
+	Size      int       `json:"size"` // Bytes in the latest frame, 0 before the first
+	Connected bool      `json:"connected"`
+	Protocol  string    `json:"protocol"` // Negotiated subprotocol
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// handleGetClients lists connected client IDs, or with ?detail=true each
+// client's stats, so a dashboard needs one request instead of N+1.
+func (ss *StreamServer) handleGetClients(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.RLock()
+	clients := make([]*Client, 0, len(ss.clients))
+	for _, client := range ss.clients {
+		clients = append(clients, client)
+	}
+	ss.mutex.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if detail, _ := strconv.ParseBool(r.URL.Query().Get("detail")); !detail {
+		clientIDs := make([]string, 0, len(clients))
+		for _, client := range clients {
+			clientIDs = append(clientIDs, client.ID)
+		}
+		json.NewEncoder(w).Encode(clientIDs)
+		return
+	}
+	summaries := make([]clientSummary, 0, len(clients))
+	for _, client := range clients {
+		stats := client.Stats()
+		summary := clientSummary{
+			ClientID:    client.ID,
+			ClientStats: stats,
+			LastSeen:    stats.LastSeen,
+			Connected:   client.Connected(), // False while detached, see detachClient
+			Protocol:    client.Protocol(),
+			Metadata:    client.GetMetadata(),
+		}
+		if frame := client.Buffer.GetLatest(); frame != nil {
+			summary.Size = frame.Size
 		}
+		summaries = append(summaries, summary)
 	}
+	json.NewEncoder(w).Encode(summaries)
 }
 
-func (ss *StreamServer) handleStreamingWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := ss.upgrader.Upgrade(w, r, nil)
-	if err != nil {
+func (ss *StreamServer) handleGetLatestFrame(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
 		return
 	}
-	viewer := &Viewer{conn: conn, send: make(chan []byte, 1024)} // Buffered channel for non-blocking sends
-	
-	viewersMutex.Lock()
-	viewers[viewer] = true
-	viewersMutex.Unlock()
+	frame := client.Buffer.GetLatest()
+	if frame == nil {
+		noFrames(w)
+		return
+	}
+	if ss.expired(frame) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	etag := frameETag(frame)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		// The poller already has this frame; its stats may be slightly stale.
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	ss.recordAccess(r, clientID, 1)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clientId":    clientID,
+		"image":       dataURI(frame),
+		"seq":         frame.Seq,
+		"timestamp":   frame.Timestamp,
+		"captureTime": frame.CaptureTime,
+		"size":        frame.Size,
+		"stats":       client.Stats(),
+	})
+}
+
+// handleGetLatestMeta describes the latest frame without the image, for
+// latency and timing analysis that polls too often to pay for base64.
+func (ss *StreamServer) handleGetLatestMeta(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	frame := client.Buffer.GetLatest()
+	if frame == nil {
+		noFrames(w)
+		return
+	}
+	if ss.expired(frame) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	stats := client.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clientId":    clientID,
+		"seq":         frame.Seq,
+		"timestamp":   frame.Timestamp,
+		"captureTime": frame.CaptureTime,
+		"size":        frame.Size,
+		"format":      frame.Format,
+		"fps":         stats.Fps,
+		"frameCount":  stats.FrameCount,
+	})
+}
 
-	go viewer.writePump()
+// expired reports whether frame is older than the configured FrameTTL and
+// should no longer be served.
+func (ss *StreamServer) expired(frame *Frame) bool {
+	return ss.config.FrameTTL > 0 && ss.clock.Since(frame.Timestamp) > ss.config.FrameTTL
+}
 
-	// Keep the connection alive by reading messages (and discarding them)
-	defer func() {
-		viewersMutex.Lock()
-		delete(viewers, viewer)
-		close(viewer.send)
-		viewersMutex.Unlock()
-	}()
-	for {
-		if _, _, err := conn.ReadMessage(); err != nil {
-			break
+// unexpired returns the frames that haven't expired, in their order.
+func (ss *StreamServer) unexpired(frames []*Frame) []*Frame {
+	if ss.config.FrameTTL <= 0 {
+		return frames
+	}
+	live := make([]*Frame, 0, len(frames))
+	for _, frame := range frames {
+		if !ss.expired(frame) {
+			live = append(live, frame)
 		}
 	}
+	return live
 }
 
-func (ss *StreamServer) handleGetClients(w http.ResponseWriter, r *http.Request) {
-	ss.mutex.RLock()
-	defer ss.mutex.RUnlock()
-	clientIDs := make([]string, 0, len(ss.clients))
-	for id := range ss.clients {
-		clientIDs = append(clientIDs, id)
+// frameETag identifies a frame for conditional GETs. The receive time is
+// included because a re-registered client restarts its sequence numbers.
+func frameETag(frame *Frame) string {
+	return fmt.Sprintf(`"%d-%x"`, frame.Seq, frame.Timestamp.UnixNano())
+}
+
+// etagMatches reports whether an If-None-Match header lists etag (or "*").
+// Weak validators compare equal to their strong form.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetFrameAt returns the buffered frame closest to ?at= (RFC 3339).
+// Only the ring buffer is searched, so times outside its window resolve to
+// the oldest or newest frame; offsetMs tells the caller how far off it is.
+func (ss *StreamServer) handleGetFrameAt(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	at, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("at"))
+	if err != nil {
+		badRequest(w, "at must be an RFC 3339 timestamp")
+		return
+	}
+	frame := client.Buffer.GetNearest(at)
+	if frame == nil || ss.expired(frame) {
+		noFrames(w)
+		return
 	}
+	ss.recordAccess(r, clientID, 1)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(clientIDs)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clientId":    clientID,
+		"image":       dataURI(frame),
+		"seq":         frame.Seq,
+		"timestamp":   frame.Timestamp,
+		"captureTime": frame.CaptureTime,
+		"size":        frame.Size,
+		"offsetMs":    frame.Timestamp.Sub(at).Milliseconds(),
+	})
 }
 
-func (ss *StreamServer) handleGetLatestFrame(w http.ResponseWriter, r *http.Request) {
+// handleSnapshot returns the latest frame as a plain image, for curl,
+// monitoring probes and <img src> polling.
+func (ss *StreamServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
 	clientID := mux.Vars(r)["id"]
 	client, ok := ss.GetClient(clientID)
 	if !ok {
-		http.NotFound(w, r)
+		clientNotFound(w)
 		return
 	}
 	frame := client.Buffer.GetLatest()
 	if frame == nil {
-		http.NotFound(w, r)
+		noFrames(w)
 		return
 	}
+	if ss.expired(frame) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	ss.recordAccess(r, clientID, 1)
+	w.Header().Set("Content-Type", mimeType(frame.Format))
+	w.Header().Set("Content-Length", strconv.Itoa(len(frame.Data)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Last-Modified", frame.Timestamp.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Frame-Timestamp", frame.Timestamp.Format(time.RFC3339Nano))
+	w.Header().Set("X-Frame-Capture-Time", frame.CaptureTime.Format(time.RFC3339Nano))
+	w.Header().Set("X-Frame-Seq", strconv.FormatUint(frame.Seq, 10))
+	w.Write(frame.Data)
+}
+
+func (ss *StreamServer) handleGetFrames(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	count := 10
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			badRequest(w, "count must be a positive integer")
+			return
+		}
+		count = n
+	}
+	frames := ss.unexpired(client.Buffer.GetLatestN(count))
+	ss.recordAccess(r, clientID, len(frames))
+	resp := make([]map[string]interface{}, 0, len(frames))
+	for _, frame := range frames {
+		resp = append(resp, map[string]interface{}{
+			"image":       dataURI(frame),
+			"seq":         frame.Seq,
+			"timestamp":   frame.Timestamp,
+			"captureTime": frame.CaptureTime,
+			"size":        frame.Size,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetBuffer describes the frames currently held in a client's ring
+// buffer, without image data, for diagnosing buffer fill and timing.
+func (ss *StreamServer) handleGetBuffer(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	frames := client.Buffer.Snapshot()
+	resp := make([]map[string]interface{}, 0, len(frames))
+	for _, frame := range frames {
+		resp = append(resp, map[string]interface{}{
+			"seq":         frame.Seq,
+			"timestamp":   frame.Timestamp,
+			"captureTime": frame.CaptureTime,
+			"size":        frame.Size,
+			"format":      frame.Format,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clientId": clientID,
+		"capacity": client.Buffer.capacity,
+		"frames":   resp,
+	})
+}
+
+// handleMJPEG streams a client's frames as multipart/x-mixed-replace so the
+// feed can be embedded in an <img> tag or opened in VLC.
+func (ss *StreamServer) handleMJPEG(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal-error", "streaming unsupported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusOK)
+
+	started := time.Now()
+	var delivered uint64
+	ss.audit.Record(AuditEvent{
+		Event:        "mjpeg_session_start",
+		Identity:     requestIdentity(r),
+		RemoteAddr:   r.RemoteAddr,
+		Cameras:      []string{clientID},
+		Path:         r.URL.Path,
+		SessionStart: &started,
+	})
+	defer func() {
+		ss.audit.Record(AuditEvent{
+			Event:           "mjpeg_session_end",
+			Identity:        requestIdentity(r),
+			RemoteAddr:      r.RemoteAddr,
+			Cameras:         []string{clientID},
+			Path:            r.URL.Path,
+			SessionStart:    &started,
+			SessionEnd:      timePtr(time.Now()),
+			FramesDelivered: delivered,
+		})
+	}()
+
+	ticker := time.NewTicker(time.Second / MAX_BROADCAST_FPS)
+	defer ticker.Stop()
+	var lastSeq uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ss.done:
+			return
+		case <-ticker.C:
+		}
+		frame := client.Buffer.GetLatest()
+		if frame == nil || frame.Seq == lastSeq || client.Paused() || ss.expired(frame) {
+			continue
+		}
+		lastSeq = frame.Seq
+		if _, err := fmt.Fprintf(w, "--frame\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", mimeType(frame.Format), len(frame.Data)); err != nil {
+			return
+		}
+		if _, err := w.Write(frame.Data); err != nil {
+			return
+		}
+		if _, err := w.Write([]byte("\r\n")); err != nil {
+			return
+		}
+		flusher.Flush()
+		delivered++
+	}
+}
+
+// handleStats reports connection counts, including how many viewers are
+// receiving each client's stream.
+func (ss *StreamServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.RLock()
+	clientIDs := make([]string, 0, len(ss.clients))
+	for id := range ss.clients {
+		clientIDs = append(clientIDs, id)
+	}
+	ss.mutex.RUnlock()
+
+	perClient := make(map[string]int, len(clientIDs))
+	clientBandwidth := make(map[string]interface{}, len(clientIDs))
+	freshness := make(map[string]interface{}, len(clientIDs))
+	for _, id := range clientIDs {
+		if client, ok := ss.GetClient(id); ok {
+			stats := client.Stats()
+			clientBandwidth[id] = map[string]interface{}{"bytesIn": stats.BytesIn, "bytesPerSec": stats.BytesPerSec}
+			freshness[id] = map[string]interface{}{"lastFrameAge": stats.LastFrameAge, "stale": stats.Stale}
+		}
+	}
+	ss.viewersMutex.RLock()
+	viewerCount := len(ss.viewers)
+	viewerBandwidth := make(map[string]interface{}, viewerCount)
+	for viewer := range ss.viewers {
+		bytesOut, bytesPerSec := viewer.Bandwidth()
+		viewerBandwidth[viewer.sessionID] = map[string]interface{}{"bytesOut": bytesOut, "bytesPerSec": bytesPerSec}
+		for _, id := range clientIDs {
+			if viewer.wants(id, ss.config.SubscribeAll) {
+				perClient[id]++
+			}
+		}
+	}
+	ss.viewersMutex.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"clientId":  clientID,
-		"image":     fmt.Sprintf("data:image/jpeg;base64,%s", base64.StdEncoding.EncodeToString(frame.Data)),
-		"timestamp": frame.Timestamp,
-		"size":      frame.Size,
-		"stats":     map[string]interface{}{"frameCount": client.Buffer.frameCount, "fps": client.fps},
+		"clients":          len(clientIDs),
+		"viewers":          viewerCount,
+		"viewersPerClient": perClient,
+		"freshness":        freshness,
+		"bandwidth": map[string]interface{}{
+			"clients": clientBandwidth,
+			"viewers": viewerBandwidth,
+		},
 	})
 }
 
+// handleHealthz is the liveness probe: it answers as long as the process can
+// serve HTTP at all.
+func (ss *StreamServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.RLock()
+	clientCount := len(ss.clients)
+	ss.mutex.RUnlock()
+	ss.viewersMutex.RLock()
+	viewerCount := len(ss.viewers)
+	ss.viewersMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "ok",
+		"clients": clientCount,
+		"viewers": viewerCount,
+		"uptime":  ss.clock.Since(ss.startTime).Round(time.Second).String(),
+	})
+}
+
+// handleReadyz is the readiness probe: 503 until startup has finished and
+// again once shutdown begins.
+func (ss *StreamServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ss.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
 func main() {
-	port := ":8080"
-	server := NewStreamServer(BUFFER_SIZE)
+	config, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fatal("config", err)
+	}
+	logger, err := newLogger(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		fatal("config", err)
+	}
+	slog.SetDefault(logger)
+
+	port := config.Addr()
+	server := NewStreamServer(config)
+	audit, err := NewAuditLog(config.AuditLog)
+	if err != nil {
+		fatal("audit log", err)
+	}
+	defer audit.Close()
+	server.audit = audit
+	switch {
+	case config.ProducerKeysFile != "":
+		if server.producerKeys, err = NewFileKeyStore(config.ProducerKeysFile); err != nil {
+			fatal("producer auth", err)
+		}
+	case config.ProducerToken != "":
+		server.producerKeys = NewMemoryKeyStore(nil) // Rotated keys last until restart
+	}
+	server.authorizeProducer = NewProducerValidator(config.ProducerToken, server.producerKeys)
+	viewerKeys, err := LoadKeys(config.ViewerKeysFile, "viewer")
+	if err != nil {
+		fatal("viewer auth", err)
+	}
+	server.authorizeViewer = NewViewerValidator(config.ViewerToken, viewerKeys)
+	viewerOnly := func(next http.HandlerFunc) http.HandlerFunc {
+		return requireViewer(server.authorizeViewer, next)
+	}
+	recorder, err := NewRecorder(config.RecordDir, config.RecordMaxBytes, SegmentPolicy{
+		Duration: config.RecordSegmentDuration,
+		Bytes:    config.RecordSegmentBytes,
+	})
+	if err != nil {
+		fatal("recorder", err)
+	}
+	server.recorder = recorder
+	server.webhook = NewWebhook(config.WebhookURL)
 	go server.cleanupInactiveClients()
+	go server.cleanupIdleViewers()
+	go server.logViewerDrops()
+	go server.sampleHistory()
 
-	r := mux.NewRouter()
-	r.Use(corsMiddleware)
+	root := mux.NewRouter()
+	r := mountRouter(root, config.BasePath)
 	r.HandleFunc("/ws", server.handleWebSocket)
 	r.HandleFunc("/stream/ws", server.handleStreamingWebSocket)
+	r.Handle("/metrics", server.metrics.handler()).Methods("GET")
+	r.HandleFunc("/healthz", server.handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", server.handleReadyz).Methods("GET")
 	api := r.PathPrefix("/api").Subrouter()
+	api.Use(accessLog(config.AccessLog))
+	api.Use(server.rateLimitAPI(newIPRateLimiter(config.APIRate)))
+	handleUnmatchedAPI(api)
 	api.HandleFunc("/clients", server.handleGetClients).Methods("GET")
-	api.HandleFunc("/clients/{id}/latest", server.handleGetLatestFrame).Methods("GET")
+	api.HandleFunc("/stats", server.handleStats).Methods("GET")
+	api.HandleFunc("/summary", server.handleSummary).Methods("GET")
+	api.HandleFunc("/compare", viewerOnly(server.handleCompare)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/latest", viewerOnly(server.handleGetLatestFrame)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/latest/meta", viewerOnly(server.handleGetLatestMeta)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/frames", viewerOnly(server.handleGetFrames)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/frame", viewerOnly(server.handleGetFrameAt)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/snapshot", viewerOnly(server.handleSnapshot)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/playback", viewerOnly(server.handlePlayback)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/thumbnail", viewerOnly(server.handleThumbnail)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/mjpeg", viewerOnly(server.handleMJPEG)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/events", viewerOnly(server.handleEvents)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/clip.gif", viewerOnly(server.handleClip)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/export.zip", viewerOnly(server.handleExport)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/history", viewerOnly(server.handleGetHistory)).Methods("GET")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/viewers", viewerOnly(server.handleGetClientViewers)).Methods("GET")
+	api.HandleFunc("/validate-frame", server.handleValidateFrame).Methods("POST")
+	api.HandleFunc("/clients/"+CLIENT_ID_ROUTE+"/buffer", requireAdmin(config.AdminToken, server.handleGetBuffer)).Methods("GET")
+	api.HandleFunc("/admin/clients/"+CLIENT_ID_ROUTE+"/disconnect", requireAdmin(config.AdminToken, server.handleAdminDisconnect)).Methods("POST")
+	api.HandleFunc("/admin/clients/"+CLIENT_ID_ROUTE+"/pause", requireAdmin(config.AdminToken, server.handleAdminPause)).Methods("POST")
+	api.HandleFunc("/admin/clients/"+CLIENT_ID_ROUTE+"/resume", requireAdmin(config.AdminToken, server.handleAdminResume)).Methods("POST")
+	api.HandleFunc("/admin/clients/"+CLIENT_ID_ROUTE+"/rotate-key", requireAdmin(config.AdminToken, server.handleAdminRotateKey)).Methods("POST")
 
-	log.Printf("🚀 Server starting on port %s", port)
-	http.ListenAndServe(port, r)
-}
\ No newline at end of file
+	// CORS wraps the router rather than using r.Use so preflight OPTIONS
+	// requests are answered even though routes only match GET or POST.
+	httpServer := newHTTPServer(config, port, corsMiddleware(config)(root))
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		fatal("listen", err)
+	}
+	server.ready.Store(true)
+	go func() {
+		var err error
+		slog.Info("server starting", "event", "server_start", "addr", port, "basePath", config.BasePath, "tls", config.TLSEnabled())
+		if config.TLSEnabled() {
+			err = httpServer.ServeTLS(listener, config.TLSCert, config.TLSKey)
+		} else {
+			err = httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("serve", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	slog.Info("shutting down", "event", "server_shutdown", "signal", sig.String())
+	server.ready.Store(false)
+
+	// Hijacked WebSocket connections are not tracked by http.Server, so close
+	// them first; Shutdown then waits for the remaining HTTP handlers.
+	server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "event", "server_shutdown", "err", err)
+	}
+	recorder.Close()
+	server.webhook.Close()
+	slog.Info("server stopped", "event", "server_stop")
+}
+
+// fatal logs a startup error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg+" failed", "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+const MAX_METADATA_VALUE = 256 // Longest accepted metadata value, in bytes
+
+// metadataFields maps the producer's metadata message onto Client.Metadata
+// keys, skipping fields the producer didn't send. It returns an error to
+// send back if the message is empty or a value is too long.
+func metadataFields(msg producerMessage) (map[string]string, *protocolError) {
+	fields := make(map[string]string)
+	for key, value := range map[string]string{
+		"resolution": msg.Resolution,
+		"device":     msg.Device,
+		"location":   msg.Location,
+	} {
+		if len(value) > MAX_METADATA_VALUE {
+			problem := newProtocolError("metadata-too-long", key+" is longer than 256 bytes")
+			return nil, &problem
+		}
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	if len(fields) == 0 {
+		problem := newProtocolError("empty-metadata", "send at least one of resolution, device or location")
+		return nil, &problem
+	}
+	return fields, nil
+}
+
+// SetMetadata merges fields into the client's device metadata and returns a
+// copy of the result.
+func (c *Client) SetMetadata(fields map[string]string) map[string]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.Metadata == nil {
+		c.Metadata = make(map[string]string, len(fields))
+	}
+	for key, value := range fields {
+		c.Metadata[key] = value
+	}
+	return c.metadataLocked()
+}
+
+// GetMetadata returns a copy of the client's device metadata, or nil if the
+// producer never sent any.
+func (c *Client) GetMetadata() map[string]string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.metadataLocked()
+}
+
+func (c *Client) metadataLocked() map[string]string {
+	if c.Metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(c.Metadata))
+	for key, value := range c.Metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// updateMetadata stores a producer's metadata message and tells the
+// client's viewers about it.
+func (ss *StreamServer) updateMetadata(client *Client, fields map[string]string) {
+	metadata := client.SetMetadata(fields)
+	slog.Info("client metadata updated", "event", "client_metadata", "clientId", client.ID, "metadata", metadata)
+	data, err := json.Marshal(map[string]interface{}{
+		"type":     "client-metadata",
+		"clientId": client.ID,
+		"metadata": metadata,
+	})
+	if err != nil {
+		return
+	}
+	ss.broadcastJSON(client.ID, data)
+}
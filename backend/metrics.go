@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverMetrics holds the Prometheus registry and the collectors that are
+// updated on the hot path. Per-client values are read on scrape by
+// streamCollector instead of being pushed on every frame, except for the
+// frame histograms, which need every observation. Their series are deleted
+// when the client is removed, see forgetClient.
+type serverMetrics struct {
+	registry       *prometheus.Registry
+	viewerDrops    *prometheus.CounterVec
+	frameSizes     *prometheus.HistogramVec
+	frameIntervals *prometheus.HistogramVec
+}
+
+func newServerMetrics(ss *StreamServer) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		viewerDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "skysentry_viewer_dropped_frames_total",
+			Help: "Frames dropped because the viewer's send buffer was full.",
+		}, []string{"viewer"}),
+		frameSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "skysentry_client_frame_size_bytes",
+			Help:    "Size of frames accepted from a producer.",
+			Buckets: prometheus.ExponentialBuckets(4<<10, 2, 11), // 4 KiB to 4 MiB
+		}, []string{"client"}),
+		frameIntervals: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "skysentry_client_frame_interval_seconds",
+			Help:    "Time between consecutive frames accepted from a producer.",
+			Buckets: []float64{.005, .01, .02, .033, .05, .067, .1, .2, .5, 1, 2, 5},
+		}, []string{"client"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.viewerDrops,
+		m.frameSizes,
+		m.frameIntervals,
+		&streamCollector{ss: ss},
+	)
+	return m
+}
+
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	clientsDesc = prometheus.NewDesc("skysentry_clients_connected",
+		"Number of registered producers.", nil, nil)
+	viewersDesc = prometheus.NewDesc("skysentry_viewers_connected",
+		"Number of connected viewers.", nil, nil)
+	framesDesc = prometheus.NewDesc("skysentry_client_frames_received_total",
+		"Frames received from a producer since it registered.", []string{"client"}, nil)
+	fpsDesc = prometheus.NewDesc("skysentry_client_fps",
+		"Current ingest frame rate of a producer.", []string{"client"}, nil)
+	bytesInDesc = prometheus.NewDesc("skysentry_client_bytes_received_total",
+		"Frame bytes received from a producer since it registered.", []string{"client"}, nil)
+	bytesInRateDesc = prometheus.NewDesc("skysentry_client_bytes_per_second",
+		"Recent ingest bandwidth of a producer.", []string{"client"}, nil)
+	bytesOutDesc = prometheus.NewDesc("skysentry_viewer_bytes_sent_total",
+		"Bytes written to a viewer since it connected.", []string{"viewer"}, nil)
+	bytesOutRateDesc = prometheus.NewDesc("skysentry_viewer_bytes_per_second",
+		"Recent delivery bandwidth of a viewer.", []string{"viewer"}, nil)
+	throttledDesc = prometheus.NewDesc("skysentry_client_frames_throttled_total",
+		"Frames refused by a producer's ingest rate limit.", []string{"client"}, nil)
+	normalizerDroppedDesc = prometheus.NewDesc("skysentry_client_frames_normalizer_dropped_total",
+		"Frames dropped because a producer's normalizer worker fell behind.", []string{"client"}, nil)
+	corruptedDesc = prometheus.NewDesc("skysentry_client_frames_corrupted_total",
+		"Frames rejected because they did not match the producer's checksum.", []string{"client"}, nil)
+)
+
+// streamCollector reports per-client and connection gauges at scrape time.
+type streamCollector struct {
+	ss *StreamServer
+}
+
+func (c *streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientsDesc
+	ch <- viewersDesc
+	ch <- framesDesc
+	ch <- fpsDesc
+	ch <- throttledDesc
+	ch <- normalizerDroppedDesc
+	ch <- corruptedDesc
+	ch <- bytesInDesc
+	ch <- bytesInRateDesc
+	ch <- bytesOutDesc
+	ch <- bytesOutRateDesc
+}
+
+func (c *streamCollector) Collect(ch chan<- prometheus.Metric) {
+	c.ss.mutex.RLock()
+	clients := make([]*Client, 0, len(c.ss.clients))
+	for _, client := range c.ss.clients {
+		clients = append(clients, client)
+	}
+	c.ss.mutex.RUnlock()
+
+	c.ss.viewersMutex.RLock()
+	viewerCount := len(c.ss.viewers)
+	for viewer := range c.ss.viewers {
+		bytesOut, bytesPerSec := viewer.Bandwidth()
+		ch <- prometheus.MustNewConstMetric(bytesOutDesc, prometheus.CounterValue, float64(bytesOut), viewer.sessionID)
+		ch <- prometheus.MustNewConstMetric(bytesOutRateDesc, prometheus.GaugeValue, bytesPerSec, viewer.sessionID)
+	}
+	c.ss.viewersMutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(len(clients)))
+	ch <- prometheus.MustNewConstMetric(viewersDesc, prometheus.GaugeValue, float64(viewerCount))
+	for _, client := range clients {
+		stats := client.Stats()
+		ch <- prometheus.MustNewConstMetric(framesDesc, prometheus.CounterValue, float64(stats.FrameCount), client.ID)
+		ch <- prometheus.MustNewConstMetric(fpsDesc, prometheus.GaugeValue, stats.Fps, client.ID)
+		ch <- prometheus.MustNewConstMetric(throttledDesc, prometheus.CounterValue, float64(stats.Dropped), client.ID)
+		ch <- prometheus.MustNewConstMetric(normalizerDroppedDesc, prometheus.CounterValue, float64(stats.NormalizerDropped), client.ID)
+		ch <- prometheus.MustNewConstMetric(corruptedDesc, prometheus.CounterValue, float64(stats.Corrupted), client.ID)
+		ch <- prometheus.MustNewConstMetric(bytesInDesc, prometheus.CounterValue, float64(stats.BytesIn), client.ID)
+		ch <- prometheus.MustNewConstMetric(bytesInRateDesc, prometheus.GaugeValue, stats.BytesPerSec, client.ID)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"time"
+)
+
+const (
+	MOTION_INTERVAL = 500 * time.Millisecond // Default time between motion samples
+	MOTION_GRID_W   = 32
+	MOTION_GRID_H   = 24
+	MOTION_SAMPLES  = 4 // Pixels sampled per cell along each axis
+)
+
+// runMotionDetector periodically compares the client's latest frame with the
+// previous sample and stores the difference as its motion score. Decoding
+// happens here rather than in AddFrame so ingest stays cheap. A motion-alert
+// is sent to the client's viewers each time the score rises past the
+// threshold, and in motion recording mode every sample above it starts or
+// extends an event.
+func (ss *StreamServer) runMotionDetector(client *Client) {
+	ticker := time.NewTicker(ss.config.MotionInterval)
+	defer ticker.Stop()
+	var prev []float64
+	var lastSeq uint64
+	alerting := false
+	for {
+		select {
+		case <-client.done:
+			if client.events != nil {
+				client.events.close()
+				// Retired for a producer re-registering under the same ID,
+				// the writer is still in use; see forgetClient.
+				if _, ok := ss.GetClient(client.ID); !ok {
+					ss.recorder.StopClient(client.ID)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+		frame := client.Buffer.GetLatest()
+		if frame == nil || frame.Seq == lastSeq {
+			continue
+		}
+		lastSeq = frame.Seq
+		img, _, err := decodeImage(frame.Data, ss.config.MaxDecodePixels)
+		if err != nil {
+			slog.Debug("motion detection skipped frame", "event", "motion_decode", "clientId", client.ID, "seq", frame.Seq, "err", err)
+			continue
+		}
+		thumb := grayThumbnail(img)
+		if prev == nil {
+			prev = thumb
+			continue
+		}
+		score := motionScore(prev, thumb)
+		prev = thumb
+
+		client.mutex.Lock()
+		client.motion = score
+		client.mutex.Unlock()
+
+		above := score >= ss.config.MotionThreshold
+		if above && client.events != nil {
+			client.events.trigger(frame.Timestamp, score)
+		}
+		if above && !alerting {
+			ss.broadcastMotionAlert(client.ID, score, frame)
+		}
+		alerting = above
+	}
+}
+
+// grayThumbnail reduces img to a MOTION_GRID_W x MOTION_GRID_H grid of mean
+// luminance values, sampling a few pixels per cell.
+func grayThumbnail(img image.Image) []float64 {
+	b := img.Bounds()
+	thumb := make([]float64, MOTION_GRID_W*MOTION_GRID_H)
+	for gy := 0; gy < MOTION_GRID_H; gy++ {
+		y0, y1 := b.Min.Y+gy*b.Dy()/MOTION_GRID_H, b.Min.Y+(gy+1)*b.Dy()/MOTION_GRID_H
+		for gx := 0; gx < MOTION_GRID_W; gx++ {
+			x0, x1 := b.Min.X+gx*b.Dx()/MOTION_GRID_W, b.Min.X+(gx+1)*b.Dx()/MOTION_GRID_W
+			var sum float64
+			var n int
+			for y := y0; y < y1; y += max(1, (y1-y0)/MOTION_SAMPLES) {
+				for x := x0; x < x1; x += max(1, (x1-x0)/MOTION_SAMPLES) {
+					sum += float64(luma(img, x, y))
+					n++
+				}
+			}
+			if n > 0 {
+				thumb[gy*MOTION_GRID_W+gx] = sum / float64(n)
+			}
+		}
+	}
+	return thumb
+}
+
+// luma returns the 8-bit luminance at (x, y), reading the Y plane directly
+// for decoded JPEGs.
+func luma(img image.Image, x, y int) uint8 {
+	if ycc, ok := img.(*image.YCbCr); ok {
+		return ycc.Y[ycc.YOffset(x, y)]
+	}
+	return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+}
+
+// motionScore is the mean absolute luminance difference between two
+// thumbnails, from 0 (identical) to 1.
+func motionScore(a, b []float64) float64 {
+	var diff float64
+	for i := range a {
+		d := a[i] - b[i]
+		if d < 0 {
+			d = -d
+		}
+		diff += d
+	}
+	return diff / float64(len(a)) / 255
+}
+
+// broadcastMotionAlert notifies every viewer receiving clientID's stream.
+func (ss *StreamServer) broadcastMotionAlert(clientID string, score float64, frame *Frame) {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      "motion-alert",
+		"clientId":  clientID,
+		"motion":    score,
+		"seq":       frame.Seq,
+		"timestamp": frame.Timestamp,
+	})
+	if err != nil {
+		return
+	}
+	slog.Info("motion detected", "event", "motion_alert", "clientId", clientID, "motion", score)
+	ss.broadcastJSON(clientID, data)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"hash/fnv"
+	"image/jpeg"
+	"log/slog"
+	"runtime"
+)
+
+const (
+	NORMALIZE_MAX_WIDTH  = 1280
+	NORMALIZE_MAX_HEIGHT = 720
+	NORMALIZE_QUALITY    = 80
+	NORMALIZE_QUEUE      = 8 // Frames waiting per normalizer worker before new ones are dropped
+)
+
+// Producers that register with "normalize": true have every frame decoded,
+// scaled down to fit the configured bounds and re-encoded as JPEG before it
+// is buffered, recorded or broadcast, so their streams are uniform and
+// bounded in size. Decoding and encoding cost far more than the rest of
+// ingest, so frames are handed from the read loop to a pool of normalizer
+// workers. A client's frames always go to the same worker, which keeps them
+// in order; when that worker falls behind, new frames are dropped and
+// counted as normalizerDropped.
+
+type normalizeJob struct {
+	clientID string
+	data     []byte
+	opts     FrameOptions
+}
+
+// normalizer is the worker pool re-encoding frames of normalizing clients.
+type normalizer struct {
+	ss        *StreamServer
+	maxWidth  int
+	maxHeight int
+	maxPixels int // Decode limit, see decodeImage
+	quality   int
+	queues    []chan normalizeJob // One per worker
+}
+
+// newNormalizer starts the config's normalizer workers. They run until the
+// server is closed.
+func newNormalizer(ss *StreamServer) *normalizer {
+	workers := ss.config.NormalizeWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	n := &normalizer{
+		ss:        ss,
+		maxWidth:  ss.config.NormalizeMaxWidth,
+		maxHeight: ss.config.NormalizeMaxHeight,
+		maxPixels: ss.config.MaxDecodePixels,
+		quality:   ss.config.NormalizeQuality,
+		queues:    make([]chan normalizeJob, workers),
+	}
+	for i := range n.queues {
+		n.queues[i] = make(chan normalizeJob, NORMALIZE_QUEUE)
+		go n.run(n.queues[i])
+	}
+	return n
+}
+
+// submit queues job on its client's worker, reporting false when that
+// worker's queue is full.
+func (n *normalizer) submit(job normalizeJob) bool {
+	h := fnv.New32a()
+	h.Write([]byte(job.clientID))
+	select {
+	case n.queues[h.Sum32()%uint32(len(n.queues))] <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *normalizer) run(queue <-chan normalizeJob) {
+	for {
+		select {
+		case <-n.ss.done:
+			return
+		case job := <-queue:
+			switch err := n.ss.AddFrame(job.clientID, n.normalize(job.data), job.opts); err {
+			case nil, ErrUnknownClient, ErrRateLimited:
+				// The client went away while queued, or was counted.
+			default:
+				slog.Warn("rejected normalized frame", "event", "frame_rejected", "clientId", job.clientID, "err", err)
+			}
+		}
+	}
+}
+
+// normalize re-encodes data as JPEG at the configured quality, scaled down
+// to fit within the configured bounds. Frames that can't be decoded are
+// kept as they are, as are JPEGs already within bounds that re-encoding
+// wouldn't make smaller.
+func (n *normalizer) normalize(data []byte) []byte {
+	src, format, err := decodeImage(data, n.maxPixels)
+	if err != nil {
+		return data
+	}
+	b := src.Bounds()
+	img := src
+	scaled := b.Dx() > n.maxWidth || b.Dy() > n.maxHeight
+	if scaled {
+		img = scaleImage(src, max(1, min(n.maxWidth, b.Dx()*n.maxHeight/max(1, b.Dy()))))
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: n.quality}); err != nil {
+		return data
+	}
+	if !scaled && format == "jpeg" && buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// ingestFrame is AddFrame for frames read from a producer, handing those of
+// normalizing clients to the normalizer. They are checked as received, so
+// producers see the same errors either way; the frame's receive time
+// becomes its capture time unless the producer sent one.
+func (ss *StreamServer) ingestFrame(clientID string, data []byte, opts FrameOptions) error {
+	client, ok := ss.GetClient(clientID)
+	if !ok || !client.normalizes() {
+		return ss.AddFrame(clientID, data, opts)
+	}
+	if _, errs := ss.checkFrame(data, opts); len(errs) > 0 {
+		return errs[0]
+	}
+	if !client.verifyChecksum(crc32.ChecksumIEEE(data), opts.Checksum) {
+		return ErrChecksumMismatch
+	}
+	opts.Format, opts.Checksum = "", nil
+	if opts.CaptureTime.IsZero() {
+		opts.CaptureTime = ss.clock.Now()
+	}
+	if !ss.normalizer.submit(normalizeJob{clientID: clientID, data: data, opts: opts}) {
+		client.mutex.Lock()
+		client.backlogged++
+		client.mutex.Unlock()
+		return ErrNormalizerBusy
+	}
+	return nil
+}
+
+// normalizes reports whether the client's frames go through the normalizer.
+func (c *Client) normalizes() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.normalize
+}
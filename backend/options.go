@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clock tells the server the time. The default reads the system clock;
+// WithClock substitutes another so fps, timeouts and cleanup can be driven
+// without sleeping.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+// systemClock is the default Clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                  { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+// Option customizes a StreamServer beyond its Config, see NewStreamServer.
+type Option func(*StreamServer)
+
+// WithBufferSize overrides the default ring buffer capacity.
+func WithBufferSize(n int) Option {
+	return func(ss *StreamServer) {
+		ss.config.BufferSize = n
+	}
+}
+
+// WithClientTimeout overrides how long a silent producer is kept.
+func WithClientTimeout(d time.Duration) Option {
+	return func(ss *StreamServer) {
+		ss.config.ClientTimeout = d
+	}
+}
+
+// WithUpgrader replaces the producer WebSocket upgrader. Viewers use a copy
+// with compression set from the config.
+func WithUpgrader(upgrader websocket.Upgrader) Option {
+	return func(ss *StreamServer) {
+		ss.upgrader = upgrader
+	}
+}
+
+// WithClock replaces the system clock.
+func WithClock(clock Clock) Option {
+	return func(ss *StreamServer) {
+		ss.clock = clock
+	}
+}
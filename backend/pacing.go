@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Paced delivery gives a viewer one message per stream per tick instead of
+// one per frame, for displays that want a steady rate regardless of
+// producer jitter. Each tick sends the stream's latest frame if it is new,
+// skipping any that arrived in between, and a frame-unchanged message
+// otherwise. Paced viewers receive nothing from broadcastFrame.
+
+// setPace starts paced delivery at fps, or stops it for fps <= 0, and
+// returns the rate in effect (0 when off). Rates above MAX_BROADCAST_FPS
+// are clamped.
+func (ss *StreamServer) setPace(viewer *Viewer, fps float64) float64 {
+	viewer.mutex.Lock()
+	defer viewer.mutex.Unlock()
+	if viewer.pace != nil {
+		close(viewer.pace)
+		viewer.pace = nil
+	}
+	if fps <= 0 {
+		return 0
+	}
+	fps = clampViewerFps(fps)
+	viewer.pace = make(chan struct{})
+	go ss.runPacer(viewer, time.Duration(float64(time.Second)/fps), viewer.pace)
+	return fps
+}
+
+// runPacer delivers to viewer every interval until stop or the viewer's
+// done channel is closed.
+func (ss *StreamServer) runPacer(viewer *Viewer, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-viewer.done:
+			return
+		case <-ticker.C:
+		}
+		ss.mutex.RLock()
+		clients := make([]*Client, 0, len(ss.clients))
+		for id, client := range ss.clients {
+			if viewer.wants(id, ss.config.SubscribeAll) {
+				clients = append(clients, client)
+			}
+		}
+		ss.mutex.RUnlock()
+		now := ss.clock.Now()
+		for _, client := range clients {
+			ss.paceFrame(viewer, client, now)
+		}
+	}
+}
+
+// paceFrame sends one tick's message for client: its latest frame if the
+// viewer hasn't had it yet, or frame-unchanged.
+func (ss *StreamServer) paceFrame(viewer *Viewer, client *Client, now time.Time) {
+	if client.Paused() {
+		return
+	}
+	frame := client.Buffer.GetLatest()
+	if frame == nil || ss.expired(frame) {
+		return
+	}
+	msg := &frameMessage{clientID: client.ID, frame: frame, stats: client.Stats()}
+
+	viewer.mutex.Lock()
+	fresh := !viewer.alreadyQueued(client, frame)
+	if fresh {
+		viewer.markQueued(client, frame)
+	}
+	viewer.mutex.Unlock()
+
+	out := msg.Unchanged()
+	if fresh {
+		out = msg.forViewer(viewer)
+	}
+	queued, dropped := viewer.queueFrame(out)
+	if fresh && !queued {
+		// Send it again next tick rather than marking a frame the viewer
+		// never received as unchanged.
+		viewer.mutex.Lock()
+		delete(viewer.lastSeq, client.ID)
+		viewer.mutex.Unlock()
+	}
+	ss.checkSlowViewer(viewer, dropped, now)
+}
+
+// checkSlowViewer records whether a frame offered to viewer was dropped and
+// disconnects it once it keeps dropping most of them, see recordOffered.
+func (ss *StreamServer) checkSlowViewer(viewer *Viewer, dropped bool, now time.Time) {
+	if viewer.recordOffered(dropped, now, ss.config.SlowViewerDropRatio) {
+		slog.Warn("disconnecting chronically slow viewer", "event", "viewer_too_slow", "sessionId", viewer.sessionID, "remoteAddr", viewer.remoteAddr)
+		viewer.disconnect("too-slow")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const MAX_PLAYBACK_SPEED = 16.0
+
+// handlePlayback upgrades to a WebSocket and replays a client's recorded
+// frames between ?from= and ?to= (RFC 3339), preserving the original
+// inter-frame timing divided by ?speed=. Frames use the same message format
+// as the live stream; ?binary=true selects binary frames.
+func (ss *StreamServer) handlePlayback(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	if ss.recorder == nil {
+		writeError(w, http.StatusNotFound, "recording-disabled", "recording is disabled")
+		return
+	}
+	q := r.URL.Query()
+	var from, to time.Time
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			badRequest(w, "from must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			badRequest(w, "to must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	speed := 1.0
+	if v := q.Get("speed"); v != "" {
+		if speed, err = strconv.ParseFloat(v, 64); err != nil || speed <= 0 || speed > MAX_PLAYBACK_SPEED {
+			badRequest(w, "speed must be greater than 0 and at most 16")
+			return
+		}
+	}
+	useBinary := q.Get("binary") == "true"
+
+	entries, err := ss.recorder.ReadIndex(clientID, from, to)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "no-recording", "nothing is recorded for this client in the requested range")
+		return
+	} else if err != nil && len(entries) == 0 {
+		writeError(w, http.StatusInternalServerError, "internal-error", err.Error())
+		return
+	}
+
+	conn, err := upgrade(&ss.viewerUpgrader, w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The reader only exists to notice the viewer going away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	started := time.Now()
+	var delivered uint64
+	ss.audit.Record(AuditEvent{
+		Event:        "playback_session_start",
+		Identity:     requestIdentity(r),
+		RemoteAddr:   r.RemoteAddr,
+		Cameras:      []string{clientID},
+		Path:         r.URL.Path,
+		SessionStart: &started,
+	})
+	defer func() {
+		ss.audit.Record(AuditEvent{
+			Event:           "playback_session_end",
+			Identity:        requestIdentity(r),
+			RemoteAddr:      r.RemoteAddr,
+			Cameras:         []string{clientID},
+			Path:            r.URL.Path,
+			SessionStart:    &started,
+			SessionEnd:      timePtr(time.Now()),
+			FramesDelivered: delivered,
+		})
+	}()
+
+	var prev time.Time
+	for _, entry := range entries {
+		if !prev.IsZero() {
+			if gap := entry.Timestamp.Sub(prev); gap > 0 {
+				timer := time.NewTimer(time.Duration(float64(gap) / speed))
+				select {
+				case <-gone:
+					timer.Stop()
+					return
+				case <-ss.done:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+		}
+		prev = entry.Timestamp
+
+		frame, err := ss.recorder.ReadFrame(clientID, entry)
+		if err != nil {
+			continue // Pruned or unreadable; skip it
+		}
+		msg := &frameMessage{
+			clientID: clientID,
+			frame:    frame,
+			stats:    ClientStats{FrameCount: frame.Seq},
+		}
+		conn.SetWriteDeadline(time.Now().Add(ss.config.ViewerWriteTimeout))
+		if useBinary {
+			err = conn.WriteMessage(websocket.BinaryMessage, msg.Binary())
+		} else {
+			err = conn.WriteMessage(websocket.TextMessage, msg.JSON())
+		}
+		if err != nil {
+			return
+		}
+		delivered++
+	}
+	conn.SetWriteDeadline(time.Now().Add(ss.config.ViewerWriteTimeout))
+	conn.WriteJSON(map[string]interface{}{"type": "playback_end", "clientId": clientID, "frames": delivered})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOversizedFrameClosesProducer(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxFrameSize = 1024
+	ss, srv := newTestServer(t, config)
+	conn := registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+	client, ok := ss.GetClient("cam")
+	if !ok {
+		t.Fatal("client not registered")
+	}
+
+	// Messages are read in order, so by the time the oversized one closes
+	// the connection the first has been buffered.
+	if err := conn.WriteMessage(websocket.BinaryMessage, testFrame(config.MaxFrameSize)); err != nil {
+		t.Fatalf("send frame at the limit: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, testFrame(config.MaxFrameSize+1)); err != nil {
+		t.Fatalf("send oversized frame: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read after oversized frame = %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+	if got := client.Buffer.FrameCount(); got != 1 {
+		t.Errorf("FrameCount = %d, want only the frame at the limit buffered", got)
+	}
+	if latest := client.Buffer.GetLatest(); latest == nil || latest.Size != config.MaxFrameSize {
+		t.Errorf("latest frame = %v, want %d bytes", latest, config.MaxFrameSize)
+	}
+}
+
+func TestAddFrameRejectsOversizedFrame(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxFrameSize = 1024
+	ss, srv := newTestServer(t, config)
+	registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+	client, _ := ss.GetClient("cam")
+
+	tests := []struct {
+		size int
+		want error
+	}{
+		{config.MaxFrameSize + 1, ErrFrameTooLarge},
+		{4 * config.MaxFrameSize, ErrFrameTooLarge},
+		{config.MaxFrameSize, nil},
+	}
+	var buffered uint64
+	for _, tt := range tests {
+		if err := ss.AddFrame("cam", testFrame(tt.size), FrameOptions{}); err != tt.want {
+			t.Errorf("AddFrame(%d bytes) = %v, want %v", tt.size, err, tt.want)
+		}
+		if tt.want == nil {
+			buffered++
+		}
+		if got := client.Buffer.FrameCount(); got != buffered {
+			t.Errorf("after %d bytes FrameCount = %d, want %d", tt.size, got, buffered)
+		}
+	}
+}
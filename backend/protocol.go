@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket clients may name the protocol version they speak in
+// Sec-WebSocket-Protocol. Clients that don't ask are assumed to speak v1,
+// the protocol that predates negotiation.
+
+const PROTOCOL_V1 = "skysentry.v1"
+
+// supportedProtocols lists the subprotocols the upgraders accept, in order
+// of preference.
+var supportedProtocols = []string{PROTOCOL_V1}
+
+var ErrUnsupportedProtocol = errors.New("no supported subprotocol requested")
+
+// upgrade upgrades r with upgrader after checking its subprotocols. A client
+// that only offers versions the server doesn't speak is refused with 400
+// before the upgrade, so it can fall back or report the mismatch.
+func upgrade(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if requested := websocket.Subprotocols(r); len(requested) > 0 && !slices.ContainsFunc(requested, supportedProtocol) {
+		badRequest(w, "unsupported subprotocol, supported: "+strings.Join(supportedProtocols, ", "))
+		return nil, ErrUnsupportedProtocol
+	}
+	return upgrader.Upgrade(w, r, nil)
+}
+
+func supportedProtocol(protocol string) bool {
+	return slices.Contains(supportedProtocols, protocol)
+}
+
+// protocolVersion returns the subprotocol negotiated on conn, PROTOCOL_V1
+// for clients that didn't ask for one, or for viewers without a WebSocket.
+func protocolVersion(conn *websocket.Conn) string {
+	if conn == nil || conn.Subprotocol() == "" {
+		return PROTOCOL_V1
+	}
+	return conn.Subprotocol()
+}
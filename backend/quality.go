@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image/jpeg"
+	"sync"
+)
+
+// Viewers on slow links can ask for frames re-encoded as JPEG at a lower
+// quality, or transcoded to WebP (see webp.go). Each variant is encoded at
+// most once per frame and shared by every viewer that asked for it; other
+// viewers get the original bytes. Variants are encoded before the viewers
+// lock is taken, see broadcastFrame, so a slow encode holds up only the
+// frame's own client.
+
+// frameVariant identifies one re-encoding of a frame.
+type frameVariant struct {
+	webp    bool
+	quality int // As the viewer asked, 0 for the original or default quality
+}
+
+// qualityVariants caches re-encoded copies of one frameMessage's frame.
+type qualityVariants struct {
+	mutex    sync.Mutex
+	variants map[frameVariant]*frameMessage
+}
+
+// withQuality returns the message to send a viewer that asked for quality
+// and, with webp, WebP delivery. It is m itself when the viewer gets the
+// original frame. Frames over maxPixels are never decoded and are sent
+// as-is.
+func (m *frameMessage) withQuality(quality int, webp bool, maxPixels int) *frameMessage {
+	if quality == 0 && (!webp || m.frame.Format == "webp") {
+		return m
+	}
+	key := frameVariant{webp: webp, quality: quality}
+	m.reencoded.mutex.Lock()
+	defer m.reencoded.mutex.Unlock()
+	if v, ok := m.reencoded.variants[key]; ok {
+		return v
+	}
+	if m.reencoded.variants == nil {
+		m.reencoded.variants = make(map[frameVariant]*frameMessage)
+	}
+	var frame *Frame
+	if webp {
+		webpQuality := quality
+		if webpQuality == 0 {
+			webpQuality = WEBP_QUALITY
+		}
+		frame = encodeWebP(m.frame, webpQuality, maxPixels)
+	}
+	if frame == nil {
+		frame = m.frame
+		if quality > 0 {
+			frame = reencodeFrame(m.frame, quality, maxPixels)
+		}
+	}
+	v := &frameMessage{
+		clientID: m.clientID,
+		frame:    frame,
+		stats:    m.stats,
+	}
+	m.reencoded.variants[key] = v
+	return v
+}
+
+// reencodeFrame returns a copy of frame encoded as JPEG at quality. Frames
+// that can't be decoded, or that wouldn't get smaller, are returned as-is.
+func reencodeFrame(frame *Frame, quality, maxPixels int) *Frame {
+	img, _, err := decodeImage(frame.Data, maxPixels)
+	if err != nil {
+		return frame
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil || buf.Len() >= frame.Size {
+		return frame
+	}
+	reencoded := *frame
+	reencoded.Data = buf.Bytes()
+	reencoded.Size = buf.Len()
+	reencoded.Format = "jpeg"
+	reencoded.Checksum = crc32.ChecksumIEEE(reencoded.Data)
+	return &reencoded
+}
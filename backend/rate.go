@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	RATE_WINDOW    = 10  // Samples used for rolling rate estimates
+	RATE_SMOOTHING = 0.3 // Weight of the newest estimate in smoothRate
+)
+
+// rateWindow estimates message and byte rates from the last RATE_WINDOW
+// samples. It is not safe for concurrent use; callers hold their own lock.
+type rateWindow struct {
+	times []time.Time
+	sizes []int
+}
+
+// add records a message of n bytes at t.
+func (w *rateWindow) add(t time.Time, n int) {
+	w.times = append(w.times, t)
+	w.sizes = append(w.sizes, n)
+	if len(w.times) > RATE_WINDOW {
+		w.times = w.times[1:]
+		w.sizes = w.sizes[1:]
+	}
+}
+
+// rates returns messages and bytes per second over the window. Both are 0
+// until there are two samples spread over time, and whenever the span is
+// not positive: duplicated timestamps, or a clock that stepped backwards.
+// Samples from time.Now carry a monotonic reading, so wall clock changes
+// don't affect the span.
+func (w *rateWindow) rates() (perSec, bytesPerSec float64) {
+	if len(w.times) < 2 {
+		return 0, 0
+	}
+	span := w.times[len(w.times)-1].Sub(w.times[0]).Seconds()
+	if span <= 0 || math.IsNaN(span) || math.IsInf(span, 0) {
+		return 0, 0
+	}
+	var bytes int
+	for _, n := range w.sizes[1:] {
+		bytes += n
+	}
+	return float64(len(w.times)-1) / span, float64(bytes) / span
+}
+
+// smoothRate blends a new rate estimate into prev with an exponentially
+// weighted moving average, so a single burst or gap doesn't make the
+// reported rate jump. Undefined estimates (0, NaN or Inf) leave prev as is.
+func smoothRate(prev, estimate float64) float64 {
+	if estimate <= 0 || math.IsNaN(estimate) || math.IsInf(estimate, 0) {
+		return prev
+	}
+	if prev <= 0 {
+		return estimate
+	}
+	return prev + RATE_SMOOTHING*(estimate-prev)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// tokenBucket limits events to rate per second, allowing bursts of up to one
+// second's worth. It is not safe for concurrent use; callers hold their own
+// lock.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// allow takes a token if one is available at now.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// A producer sends up to two messages per frame (frame-meta and the image),
+// so the default message rate leaves headroom for one streaming at
+// MAX_BROADCAST_FPS, the most any viewer is sent. Viewers
+// send far fewer; the limit exists to stop a connection spinning the JSON
+// decoder with control-message spam.
+const MAX_MESSAGE_RATE = 4 * MAX_BROADCAST_FPS
+
+// messageLimiter caps the messages one WebSocket connection may send. It is
+// only used by the connection's read loop. A nil *messageLimiter allows
+// everything.
+type messageLimiter struct {
+	bucket *tokenBucket
+}
+
+func newMessageLimiter(rate float64) *messageLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &messageLimiter{bucket: newTokenBucket(rate)}
+}
+
+// allow reports whether another message may be read. Once it returns false
+// the caller closes the connection with closePolicyViolation.
+func (l *messageLimiter) allow() bool {
+	return l == nil || l.bucket.allow(time.Now())
+}
+
+// closePolicyViolation tells the peer why its connection is being closed.
+// WriteControl is safe alongside the connection's other writer.
+func closePolicyViolation(conn *websocket.Conn, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+}
+
+const API_LIMITER_IDLE = time.Minute // Per-IP buckets unused this long are forgotten
+
+// ipRateLimiter keeps a token bucket per remote IP. A nil *ipRateLimiter
+// allows everything.
+type ipRateLimiter struct {
+	rate float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(rate float64) *ipRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &ipRateLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from ip's bucket at now. Idle buckets are swept now
+// and then so the map doesn't grow with every address ever seen.
+func (l *ipRateLimiter) allow(ip string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.lastSweep) > API_LIMITER_IDLE {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.last) > API_LIMITER_IDLE {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = newTokenBucket(l.rate)
+		l.buckets[ip] = bucket
+	}
+	return bucket.allow(now)
+}
+
+// rateLimitAPI answers requests beyond the limiter's per-IP rate with 429
+// and a Retry-After header. WebSocket upgrades (playback) are exempt; their
+// messages are limited by messageLimiter instead.
+func (ss *StreamServer) rateLimitAPI(limiter *ipRateLimiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !websocket.IsWebSocketUpgrade(r) && !limiter.allow(remoteIP(r), ss.clock.Now()) {
+				ss.rejectHTTP(w, http.StatusTooManyRequests, "rate-limited")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// remoteIP returns the address of the peer that sent r, without its port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
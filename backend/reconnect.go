@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With a ReconnectGrace, a producer whose connection drops is detached
+// rather than removed: its Client stays registered, with its ring buffer,
+// sequence numbers, stats and metadata, and viewers keep their
+// subscriptions. Re-registering the same ID within the grace period
+// reattaches the new connection to it; otherwise the cleanup loop removes
+// it once the grace period has passed on ss.clock, checking at least every
+// ReconnectGrace. Kicked producers are removed immediately.
+
+// detachClient is removeClientConn for a producer whose connection was
+// lost, keeping the client for ReconnectGrace when that is set.
+func (ss *StreamServer) detachClient(clientID string, conn *websocket.Conn) bool {
+	if ss.config.ReconnectGrace <= 0 {
+		return ss.removeClientConn(clientID, conn)
+	}
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	client, ok := ss.clients[clientID]
+	if !ok || !client.owns(conn) {
+		return false
+	}
+	client.mutex.Lock()
+	client.detached = ss.clock.Now()
+	client.mutex.Unlock()
+	return true
+}
+
+// removeExpiredDetached removes clients that have been detached for longer
+// than ReconnectGrace and returns their IDs.
+func (ss *StreamServer) removeExpiredDetached() []string {
+	if ss.config.ReconnectGrace <= 0 {
+		return nil
+	}
+	var expired []*Client
+	ss.mutex.Lock()
+	for id, client := range ss.clients {
+		client.mutex.RLock()
+		detached := client.detached
+		client.mutex.RUnlock()
+		if !detached.IsZero() && ss.clock.Since(detached) > ss.config.ReconnectGrace {
+			client.stop()
+			delete(ss.clients, id)
+			expired = append(expired, client)
+		}
+	}
+	ss.mutex.Unlock()
+	ids := make([]string, len(expired))
+	for i, client := range expired {
+		ids[i] = client.ID
+		ss.forgetClient(client)
+		slog.Info("reconnect grace expired", "event", "client_cleanup", "clientId", client.ID, "grace", ss.config.ReconnectGrace.String())
+		ss.notify("client_disconnected", client.ID, "")
+		ss.announceClient("client-disconnected", client.ID, "disconnected")
+	}
+	return ids
+}
+
+// reattach moves a detached client onto the connection of its reconnected
+// producer, applying the new registration's options. Callers must hold
+// ss.mutex.
+func (c *Client) reattach(conn *websocket.Conn, opts ClientOptions) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn = conn
+	c.protocol = protocolVersion(conn)
+	c.verify = opts.Verify
+	c.normalize = opts.Normalize
+	c.limiter = nil
+	if opts.MaxFps > 0 {
+		c.limiter = newTokenBucket(opts.MaxFps)
+	}
+	c.detached = time.Time{}
+	c.LastSeen = c.clock.Now()
+}
+
+// canReattach reports whether a producer registering with opts may take
+// over this client instead of replacing it: it must be detached and have
+// asked for the same kind of client and buffer. Callers must hold ss.mutex.
+func (c *Client) canReattach(opts ClientOptions, bufferSize int) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !c.detached.IsZero() && !c.closed && c.stream == opts.Stream && c.Buffer.capacity == bufferSize
+}
+
+// Connected reports whether the client's producer is connected, as opposed
+// to detached within its reconnect grace period.
+func (c *Client) Connected() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.detached.IsZero()
+}
+
+// connection returns the connection the client's frames arrive on.
+func (c *Client) connection() *websocket.Conn {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.conn
+}
+
+// Protocol returns the subprotocol negotiated with the client's producer.
+func (c *Client) Protocol() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.protocol
+}
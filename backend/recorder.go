@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_QUEUE     = 64 // Frames waiting to be written per client
+	RECORD_INDEX     = "index.jsonl"
+	RECORD_TIME_NAME = "20060102T150405.000000000Z"
+	RECORD_MANIFEST  = "manifest.json"
+)
+
+// IndexEntry is one line of a client's recording index.
+type IndexEntry struct {
+	File        string    `json:"file"`
+	Seq         uint64    `json:"seq"`
+	Timestamp   time.Time `json:"timestamp"`
+	CaptureTime time.Time `json:"captureTime"`
+	Size        int       `json:"size"`
+	Format      string    `json:"format"`
+}
+
+// recordJob is a frame to write, or a manifest to (re)write, in subdir of
+// the client's recording directory.
+type recordJob struct {
+	subdir   string
+	frame    *Frame
+	manifest *EventManifest
+}
+
+type recordedFile struct {
+	path string
+	size int64
+}
+
+// Recorder persists frames to {dir}/{clientId}/{timestamp}.{ext} and keeps
+// a per-client index.jsonl. Each client has its own writer goroutine so disk
+// I/O never blocks ingest; when the queue is full frames are skipped. Total
+// image bytes on disk are capped by maxBytes, deleting the oldest files
+// first. In motion mode frames are grouped into per-event subdirectories,
+// see eventRecorder, and with a SegmentPolicy into segments, see
+// segmentWriter. A nil *Recorder records nothing.
+type Recorder struct {
+	dir      string
+	maxBytes int64
+	segments SegmentPolicy
+
+	mutex    sync.Mutex
+	writers  map[string]*clientWriter
+	draining map[string]*clientWriter // Stopped by StopClient but still flushing their queue
+	files    []recordedFile           // Oldest first
+	total    int64
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewRecorder creates the recording directory and accounts for frames left
+// by previous runs so the disk cap covers them too. An empty dir disables
+// recording and returns nil.
+func NewRecorder(dir string, maxBytes int64, segments SegmentPolicy) (*Recorder, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create record dir: %w", err)
+	}
+	rec := &Recorder{
+		dir:      dir,
+		maxBytes: maxBytes,
+		segments: segments,
+		writers:  make(map[string]*clientWriter),
+		draining: make(map[string]*clientWriter),
+	}
+	type existing struct {
+		recordedFile
+		mod time.Time
+	}
+	var found []existing
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == RECORD_INDEX || d.Name() == RECORD_MANIFEST {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			found = append(found, existing{recordedFile{path, info.Size()}, info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(found, func(i, j int) bool { return found[i].mod.Before(found[j].mod) })
+	for _, f := range found {
+		rec.files = append(rec.files, f.recordedFile)
+		rec.total += f.size
+	}
+	rec.prune()
+	return rec, nil
+}
+
+// Record queues a frame for writing without blocking.
+func (rec *Recorder) Record(clientID string, frame *Frame) {
+	rec.enqueue(clientID, recordJob{frame: frame})
+}
+
+// RecordEvent queues a frame belonging to a motion event, written to the
+// event's directory but indexed with the client's other frames.
+func (rec *Recorder) RecordEvent(clientID, subdir string, frame *Frame) {
+	rec.enqueue(clientID, recordJob{subdir: subdir, frame: frame})
+}
+
+// WriteManifest queues (re)writing the manifest of the event in subdir.
+func (rec *Recorder) WriteManifest(clientID, subdir string, manifest EventManifest) {
+	rec.enqueue(clientID, recordJob{subdir: subdir, manifest: &manifest})
+}
+
+func (rec *Recorder) enqueue(clientID string, job recordJob) {
+	if rec == nil {
+		return
+	}
+	// The send happens under the lock so Close can't close the queue
+	// underneath it; it never blocks.
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.closed {
+		return
+	}
+	writer, ok := rec.writers[clientID]
+	if !ok {
+		writer = &clientWriter{queue: make(chan recordJob, RECORD_QUEUE), done: make(chan struct{})}
+		rec.writers[clientID] = writer
+		rec.wg.Add(1)
+		go rec.writeLoop(clientID, writer, rec.draining[clientID])
+	}
+
+	select {
+	case writer.queue <- job:
+	default:
+		if job.frame != nil {
+			slog.Warn("recording queue full, skipping frame", "event", "record_drop", "clientId", clientID, "seq", job.frame.Seq)
+		} else {
+			slog.Warn("recording queue full, skipping manifest", "event", "record_drop", "clientId", clientID, "dir", job.subdir)
+		}
+	}
+}
+
+// StopClient flushes clientID's queued frames and stops its writer, for a
+// client that has been removed. Frames recorded for the ID later start a new
+// writer, which waits for this one to finish first.
+func (rec *Recorder) StopClient(clientID string) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	writer, ok := rec.writers[clientID]
+	if !ok || rec.closed {
+		return
+	}
+	close(writer.queue)
+	delete(rec.writers, clientID)
+	rec.draining[clientID] = writer
+}
+
+// Close flushes queued frames and stops all writers.
+func (rec *Recorder) Close() {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	rec.closed = true
+	for _, writer := range rec.writers {
+		close(writer.queue)
+	}
+	rec.mutex.Unlock()
+	rec.wg.Wait()
+}
+
+// clientDir returns the directory holding clientID's recording. A named
+// stream's is nested in its producer's, {clientId}/streams/{streamId}, so it
+// can't share a directory with another client's.
+func (rec *Recorder) clientDir(clientID string) string {
+	if id, streamID, ok := strings.Cut(clientID, STREAM_SEPARATOR); ok {
+		return filepath.Join(rec.dir, safePathComponent(id), RECORD_STREAMS, safePathComponent(streamID))
+	}
+	return filepath.Join(rec.dir, safePathComponent(clientID))
+}
+
+// clientWriter is the queue of one client's writeLoop.
+type clientWriter struct {
+	queue chan recordJob
+	done  chan struct{} // Closed when its writeLoop returns
+}
+
+// writeLoop writes clientID's jobs until its queue is closed. prev is the
+// ID's previous writer if it is still draining; it is waited for so two
+// writers never share a segment.
+func (rec *Recorder) writeLoop(clientID string, writer, prev *clientWriter) {
+	defer rec.wg.Done()
+	defer func() {
+		rec.mutex.Lock()
+		if rec.draining[clientID] == writer {
+			delete(rec.draining, clientID)
+		}
+		rec.mutex.Unlock()
+		close(writer.done)
+	}()
+	if prev != nil {
+		<-prev.done
+	}
+	w := newSegmentWriter(rec, clientID)
+	defer w.close()
+	for {
+		select {
+		case job, ok := <-writer.queue:
+			if !ok {
+				return
+			}
+			w.write(job)
+		case <-w.expired:
+			w.expire()
+		}
+	}
+}
+
+// writeManifest replaces the manifest in dir, writing a temporary file first
+// so readers never see a partial one.
+func (rec *Recorder) writeManifest(clientID, dir string, manifest *EventManifest) {
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	tmp := filepath.Join(dir, RECORD_MANIFEST+".tmp")
+	err := os.MkdirAll(dir, 0o755)
+	if err == nil {
+		err = os.WriteFile(tmp, append(data, '\n'), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, RECORD_MANIFEST))
+	}
+	if err != nil {
+		slog.Error("recording manifest failed", "event", "record_error", "clientId", clientID, "err", err)
+	}
+}
+
+// prune deletes the oldest recorded files until the total is under
+// maxBytes. Index lines for deleted files are left in place; readers skip
+// entries whose file is gone. Callers must hold rec.mutex (or own rec
+// exclusively).
+func (rec *Recorder) prune() {
+	if rec.maxBytes <= 0 {
+		return
+	}
+	for rec.total > rec.maxBytes && len(rec.files) > 0 {
+		oldest := rec.files[0]
+		rec.files = rec.files[1:]
+		rec.total -= oldest.size
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			slog.Error("pruning recording failed", "event", "record_error", "path", oldest.path, "err", err)
+		}
+	}
+}
+
+// fileExtension returns the file extension used for a frame format.
+func fileExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// safePathComponent makes a client ID usable as a single directory name.
+func safePathComponent(id string) string {
+	id = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, id)
+	if id == "" || id == "." || id == ".." {
+		id = "_" + id
+	}
+	return id
+}
+
+// ReadIndex returns clientID's recorded frames between from and to
+// (inclusive, zero values are unbounded) in recording order, across the
+// client's directory and its segments.
+func (rec *Recorder) ReadIndex(clientID string, from, to time.Time) ([]IndexEntry, error) {
+	dir := rec.clientDir(clientID)
+	entries, err := readIndexFile(filepath.Join(dir, RECORD_INDEX), "", from, to)
+	found := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return entries, err
+	}
+	segments, _ := os.ReadDir(filepath.Join(dir, RECORD_SEGMENTS))
+	for _, seg := range segments {
+		start, err := time.Parse(RECORD_TIME_NAME, seg.Name())
+		if err != nil || !seg.IsDir() {
+			continue
+		}
+		if !to.IsZero() && start.After(to) {
+			break // Segments are sorted by start time
+		}
+		segEntries, err := readIndexFile(filepath.Join(dir, RECORD_SEGMENTS, seg.Name(), RECORD_INDEX), path.Join(RECORD_SEGMENTS, seg.Name()), from, to)
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		entries = append(entries, segEntries...)
+		if err != nil {
+			return entries, err
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	// Frames recorded before segments were turned on (or after they were
+	// turned off) are in the client's own index.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+	return entries, nil
+}
+
+// readIndexFile reads the entries of one index.jsonl between from and to,
+// making their file names relative to the client's directory by prefixing
+// dir.
+func readIndexFile(file, dir string, from, to time.Time) ([]IndexEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []IndexEntry
+	dec := json.NewDecoder(f)
+	for {
+		var e IndexEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return entries, fmt.Errorf("read index: %w", err)
+		}
+		if (!from.IsZero() && e.Timestamp.Before(from)) || (!to.IsZero() && e.Timestamp.After(to)) {
+			continue
+		}
+		e.File = path.Join(dir, e.File)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ReadFrame loads the image referenced by an index entry. Entries name a
+// file in the client's directory or, for segments and motion events, below
+// it.
+func (rec *Recorder) ReadFrame(clientID string, e IndexEntry) (*Frame, error) {
+	name := filepath.FromSlash(e.File)
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid index entry %q", e.File)
+	}
+	data, err := os.ReadFile(filepath.Join(rec.clientDir(clientID), name))
+	if err != nil {
+		return nil, err
+	}
+	frame := &Frame{
+		Data:        data,
+		Timestamp:   e.Timestamp,
+		CaptureTime: e.CaptureTime,
+		Size:        len(data),
+		Format:      e.Format,
+		Seq:         e.Seq,
+	}
+	if frame.CaptureTime.IsZero() {
+		frame.CaptureTime = frame.Timestamp // Recorded before capture times were kept
+	}
+	return frame, nil
+}
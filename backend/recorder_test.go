@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorderClientDir(t *testing.T) {
+	rec := &Recorder{dir: "rec"}
+	tests := []struct {
+		clientID string
+		want     string
+	}{
+		{"cam", "rec/cam"},
+		{"cam_wide", "rec/cam_wide"},
+		{"cam/wide", "rec/cam/streams/wide"},
+		{"cam.1/zoom", "rec/cam.1/streams/zoom"},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		got := rec.clientDir(tt.clientID)
+		if got != filepath.FromSlash(tt.want) {
+			t.Errorf("clientDir(%q) = %q, want %q", tt.clientID, got, tt.want)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("clientDir(%q) and clientDir(%q) are both %q", tt.clientID, other, got)
+		}
+		seen[got] = tt.clientID
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// seqs returns the sequence numbers of frames, oldest first.
+func seqs(frames []*Frame) []uint64 {
+	out := make([]uint64, len(frames))
+	for i, frame := range frames {
+		out[i] = frame.Seq
+	}
+	return out
+}
+
+func equalSeqs(got, want []uint64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fillRingBuffer adds n frames one second apart, starting at start.
+func fillRingBuffer(rb *RingBuffer, n int, start time.Time) {
+	for i := 0; i < n; i++ {
+		rb.Add(&Frame{Data: []byte{byte(i)}, Size: 1, Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name       string
+		capacity   int
+		adds       int
+		wantLatest uint64 // 0 for an empty buffer
+		wantFrames []uint64
+	}{
+		{"empty", 3, 0, 0, []uint64{}},
+		{"partly filled", 3, 2, 2, []uint64{1, 2}},
+		{"full", 3, 3, 3, []uint64{1, 2, 3}},
+		{"wrapped", 3, 5, 5, []uint64{3, 4, 5}},
+		{"wrapped twice", 3, 7, 7, []uint64{5, 6, 7}},
+		{"live only", 1, 4, 4, []uint64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := NewRingBuffer(tt.capacity)
+			fillRingBuffer(rb, tt.adds, time.Unix(0, 0))
+
+			latest := rb.GetLatest()
+			switch {
+			case tt.wantLatest == 0 && latest != nil:
+				t.Errorf("GetLatest() = seq %d, want nil", latest.Seq)
+			case tt.wantLatest != 0 && (latest == nil || latest.Seq != tt.wantLatest):
+				t.Errorf("GetLatest() = %v, want seq %d", latest, tt.wantLatest)
+			}
+			if got := seqs(rb.Snapshot()); !equalSeqs(got, tt.wantFrames) {
+				t.Errorf("Snapshot() = %v, want %v", got, tt.wantFrames)
+			}
+			if got := rb.FrameCount(); got != uint64(tt.adds) {
+				t.Errorf("FrameCount() = %d, want %d", got, tt.adds)
+			}
+		})
+	}
+}
+
+func TestRingBufferGetLatestN(t *testing.T) {
+	rb := NewRingBuffer(4)
+	fillRingBuffer(rb, 6, time.Unix(0, 0))
+	tests := []struct {
+		n    int
+		want []uint64
+	}{
+		{-1, []uint64{}},
+		{0, []uint64{}},
+		{1, []uint64{6}},
+		{3, []uint64{4, 5, 6}},
+		{4, []uint64{3, 4, 5, 6}},
+		{10, []uint64{3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		if got := seqs(rb.GetLatestN(tt.n)); !equalSeqs(got, tt.want) {
+			t.Errorf("GetLatestN(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRingBufferGetSince(t *testing.T) {
+	rb := NewRingBuffer(4)
+	fillRingBuffer(rb, 6, time.Unix(0, 0))
+	tests := []struct {
+		name string
+		seq  uint64
+		want []uint64
+	}{
+		{"from the start", 0, []uint64{3, 4, 5, 6}},
+		{"behind the buffer", 1, []uint64{3, 4, 5, 6}},
+		{"inside the buffer", 4, []uint64{5, 6}},
+		{"caught up", 6, []uint64{}},
+		{"stream restarted", 10, []uint64{3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := seqs(rb.GetSince(tt.seq)); !equalSeqs(got, tt.want) {
+				t.Errorf("GetSince(%d) = %v, want %v", tt.seq, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingBufferGetNearest(t *testing.T) {
+	start := time.Unix(1000, 0)
+	rb := NewRingBuffer(4)
+	if frame := rb.GetNearest(start); frame != nil {
+		t.Fatalf("GetNearest on an empty buffer = seq %d, want nil", frame.Seq)
+	}
+	fillRingBuffer(rb, 6, start) // Keeps seqs 3-6, at start+2s to start+5s
+	tests := []struct {
+		name string
+		at   time.Time
+		want uint64
+	}{
+		{"exact", start.Add(4 * time.Second), 5},
+		{"between", start.Add(3400 * time.Millisecond), 4},
+		{"before the oldest", start, 3},
+		{"after the newest", start.Add(time.Hour), 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if frame := rb.GetNearest(tt.at); frame == nil || frame.Seq != tt.want {
+				t.Errorf("GetNearest() = %v, want seq %d", frame, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const RECORD_SEGMENTS = "segments" // Subdirectory of a client's recording holding its segments
+
+// SegmentPolicy splits a client's recording into segments, directories
+// below {clientId}/segments/ named after their first frame's receive time
+// in RECORD_TIME_NAME. Each segment has its own index.jsonl and motion
+// events, so a segment can be archived or deleted on its own. A zero policy
+// records straight into the client's directory.
+type SegmentPolicy struct {
+	Duration time.Duration // Start a new segment after this long, 0 never
+	Bytes    int64         // Start a new segment before exceeding this many image bytes, 0 never
+}
+
+func (p SegmentPolicy) enabled() bool {
+	return p.Duration > 0 || p.Bytes > 0
+}
+
+// openSegment is the directory a client writer is currently recording into.
+type openSegment struct {
+	dir   string // Absolute; the client's directory when segments are off
+	start time.Time
+	bytes int64 // Image bytes written so far
+	index *os.File
+}
+
+// segmentWriter writes one client's frames, index and manifests, rotating
+// segments as its policy requires. It is owned by the client's writeLoop,
+// so rotation happens off the ingest path. A segment only rotates between
+// frames, and never while a motion event is being recorded, so events stay
+// whole; the rotation is then made with the first frame after the event.
+type segmentWriter struct {
+	rec      *Recorder
+	clientID string
+	dir      string // The client's recording directory
+	policy   SegmentPolicy
+
+	seg     *openSegment
+	resumed bool            // The latest existing segment was considered for reuse
+	events  map[string]bool // Event subdirectories whose final manifest is pending
+	timer   *time.Timer
+	expired <-chan time.Time // Fires when the open segment's duration is up
+}
+
+func newSegmentWriter(rec *Recorder, clientID string) *segmentWriter {
+	return &segmentWriter{
+		rec:      rec,
+		clientID: clientID,
+		dir:      rec.clientDir(clientID),
+		policy:   rec.segments,
+		events:   make(map[string]bool),
+	}
+}
+
+// write handles one job from the client's queue.
+func (w *segmentWriter) write(job recordJob) {
+	if job.frame != nil {
+		w.rotate(job.frame.Timestamp, int64(len(job.frame.Data)))
+	}
+	// Segments are named after their earliest frame, which for a motion
+	// event is the start of its pre-roll.
+	at := time.Now()
+	if job.frame != nil {
+		at = job.frame.Timestamp
+	} else if job.manifest != nil {
+		at = job.manifest.Start
+	}
+	if err := w.open(at); err != nil {
+		slog.Error("recording failed", "event", "record_error", "clientId", w.clientID, "err", err)
+		return
+	}
+	if job.manifest != nil {
+		if job.manifest.End == nil {
+			w.events[job.subdir] = true
+		} else {
+			delete(w.events, job.subdir)
+		}
+		w.rec.writeManifest(w.clientID, filepath.Join(w.seg.dir, filepath.FromSlash(job.subdir)), job.manifest)
+		return
+	}
+
+	frame := job.frame
+	name := path.Join(job.subdir, frame.Timestamp.UTC().Format(RECORD_TIME_NAME)+"."+fileExtension(frame.Format))
+	file := filepath.Join(w.seg.dir, filepath.FromSlash(name))
+	if job.subdir != "" {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			slog.Error("recording failed", "event", "record_error", "clientId", w.clientID, "err", err)
+			return
+		}
+	}
+	if err := os.WriteFile(file, frame.Data, 0o644); err != nil {
+		slog.Error("recording frame failed", "event", "record_error", "clientId", w.clientID, "seq", frame.Seq, "err", err)
+		return
+	}
+	line, _ := json.Marshal(IndexEntry{
+		File:        name,
+		Seq:         frame.Seq,
+		Timestamp:   frame.Timestamp,
+		CaptureTime: frame.CaptureTime,
+		Size:        frame.Size,
+		Format:      frame.Format,
+	})
+	if _, err := w.seg.index.Write(append(line, '\n')); err != nil {
+		slog.Error("recording index failed", "event", "record_error", "clientId", w.clientID, "err", err)
+	}
+	w.seg.bytes += int64(len(frame.Data))
+
+	w.rec.mutex.Lock()
+	w.rec.files = append(w.rec.files, recordedFile{file, int64(len(frame.Data))})
+	w.rec.total += int64(len(frame.Data))
+	w.rec.prune()
+	w.rec.mutex.Unlock()
+}
+
+// rotate closes the open segment if a frame received at with size bytes
+// belongs in the next one.
+func (w *segmentWriter) rotate(at time.Time, size int64) {
+	if w.seg == nil || !w.policy.enabled() || len(w.events) > 0 {
+		return
+	}
+	full := w.policy.Bytes > 0 && w.seg.bytes > 0 && w.seg.bytes+size > w.policy.Bytes
+	due := w.policy.Duration > 0 && !at.Before(w.seg.start.Add(w.policy.Duration))
+	if full || due {
+		w.close()
+	}
+}
+
+// expire closes the open segment once its duration is up, so a client that
+// stops sending doesn't hold it open. During a motion event it is left for
+// rotate to close after the event.
+func (w *segmentWriter) expire() {
+	w.expired = nil
+	if len(w.events) == 0 {
+		w.close()
+	}
+}
+
+// open makes sure a segment is open, starting one at the given time if
+// needed. After a restart the latest segment is reused while it is within
+// the policy, so recording resumes where it left off.
+func (w *segmentWriter) open(at time.Time) error {
+	if w.seg != nil {
+		return nil
+	}
+	seg := &openSegment{dir: w.dir, start: at}
+	if w.policy.enabled() {
+		var resumed *openSegment
+		if !w.resumed {
+			w.resumed = true
+			resumed = w.latestSegment(at)
+		}
+		if resumed != nil {
+			seg = resumed
+		} else {
+			seg.dir = filepath.Join(w.dir, RECORD_SEGMENTS, at.UTC().Format(RECORD_TIME_NAME))
+		}
+	}
+	if err := os.MkdirAll(seg.dir, 0o755); err != nil {
+		return err
+	}
+	index, err := os.OpenFile(filepath.Join(seg.dir, RECORD_INDEX), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	seg.index = index
+	w.seg = seg
+	if w.policy.enabled() {
+		slog.Info("recording segment opened", "event", "record_segment", "clientId", w.clientID, "segment", filepath.Base(seg.dir), "bytes", seg.bytes)
+	}
+	if w.policy.Duration > 0 {
+		w.timer = time.NewTimer(time.Until(seg.start.Add(w.policy.Duration)))
+		w.expired = w.timer.C
+	}
+	return nil
+}
+
+// latestSegment returns the client's most recent segment if it can still
+// take frames received at the given time, or nil.
+func (w *segmentWriter) latestSegment(at time.Time) *openSegment {
+	entries, err := os.ReadDir(filepath.Join(w.dir, RECORD_SEGMENTS))
+	if err != nil || len(entries) == 0 {
+		return nil
+	}
+	last := entries[len(entries)-1]
+	start, err := time.Parse(RECORD_TIME_NAME, last.Name())
+	if err != nil || !last.IsDir() {
+		return nil
+	}
+	if w.policy.Duration > 0 && !at.Before(start.Add(w.policy.Duration)) {
+		return nil
+	}
+	seg := &openSegment{dir: filepath.Join(w.dir, RECORD_SEGMENTS, last.Name()), start: start}
+	filepath.WalkDir(seg.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == RECORD_INDEX || d.Name() == RECORD_MANIFEST {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			seg.bytes += info.Size()
+		}
+		return nil
+	})
+	if w.policy.Bytes > 0 && seg.bytes >= w.policy.Bytes {
+		return nil
+	}
+	return seg
+}
+
+// close closes the open segment, if any.
+func (w *segmentWriter) close() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer, w.expired = nil, nil
+	}
+	if w.seg != nil {
+		w.seg.index.Close()
+		w.seg = nil
+	}
+}
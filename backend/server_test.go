@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
+
+// testRouter routes the producer and viewer WebSocket endpoints to ss.
+func testRouter(ss *StreamServer) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/ws", ss.handleWebSocket)
+	r.HandleFunc("/stream/ws", ss.handleStreamingWebSocket)
+	return r
+}
+
+// newTestServer starts ss behind an httptest server. Both are closed when
+// the test ends.
+func newTestServer(t *testing.T, config Config, opts ...Option) (*StreamServer, *httptest.Server) {
+	t.Helper()
+	ss := NewStreamServer(config, opts...)
+	srv := httptest.NewServer(testRouter(ss))
+	t.Cleanup(func() {
+		ss.Close()
+		srv.Close()
+	})
+	return ss, srv
+}
+
+// wsURL turns srv's http(s) URL into a ws(s) URL for path.
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + path
+}
+
+// testFrame returns a size-byte frame that passes format detection as JPEG.
+func testFrame(size int) []byte {
+	data := make([]byte, size)
+	copy(data, []byte{0xFF, 0xD8, 0xFF})
+	return data
+}
+
+// registerProducer connects to /ws with dialer and registers clientID,
+// failing the test unless the server accepts it.
+func registerProducer(t *testing.T, dialer *websocket.Dialer, url, clientID string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(map[string]string{"type": "client-registration", "clientId": clientID}); err != nil {
+		t.Fatalf("send registration: %v", err)
+	}
+	var ack map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatalf("read registration reply: %v", err)
+	}
+	if ack["type"] != "registration-success" {
+		t.Fatalf("registration reply = %v, want registration-success", ack)
+	}
+	return conn
+}
+
+func TestAddFrameFps(t *testing.T) {
+	tests := []struct {
+		name     string
+		frames   int
+		interval time.Duration
+		want     float64
+	}{
+		{"no frames", 0, 100 * time.Millisecond, 0},
+		{"single frame", 1, 100 * time.Millisecond, 0},
+		{"two frames", 2, 100 * time.Millisecond, 10},
+		{"10 fps", 5, 100 * time.Millisecond, 10},
+		{"30 fps past the window", 3 * RATE_WINDOW, time.Second / 30, 30},
+		{"same timestamp", 5, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			ss, srv := newTestServer(t, DefaultConfig(), WithClock(clock))
+			registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+
+			for i := 0; i < tt.frames; i++ {
+				if i > 0 {
+					clock.Advance(tt.interval)
+				}
+				if err := ss.AddFrame("cam", testFrame(64), FrameOptions{}); err != nil {
+					t.Fatalf("AddFrame: %v", err)
+				}
+			}
+			client, ok := ss.GetClient("cam")
+			if !ok {
+				t.Fatal("client not registered")
+			}
+			stats := client.Stats()
+			if math.Abs(stats.Fps-tt.want) > 0.01 {
+				t.Errorf("Fps = %v, want %v", stats.Fps, tt.want)
+			}
+			if stats.FrameCount != uint64(tt.frames) {
+				t.Errorf("FrameCount = %d, want %d", stats.FrameCount, tt.frames)
+			}
+		})
+	}
+}
+
+func TestAddFrameUnknownClient(t *testing.T) {
+	ss, _ := newTestServer(t, DefaultConfig(), WithClock(newFakeClock()))
+	if err := ss.AddFrame("nobody", testFrame(64), FrameOptions{}); err != ErrUnknownClient {
+		t.Errorf("AddFrame for an unregistered client = %v, want ErrUnknownClient", err)
+	}
+}
+
+func TestRemoveInactiveClients(t *testing.T) {
+	const timeout = 30 * time.Second
+	tests := []struct {
+		name        string
+		idle        []time.Duration // Silences, each followed by a frame except the last
+		wantRemoved bool
+	}{
+		{"just registered", []time.Duration{0}, false},
+		{"silent within the timeout", []time.Duration{29 * time.Second}, false},
+		{"silent for exactly the timeout", []time.Duration{timeout}, false},
+		{"silent past the timeout", []time.Duration{31 * time.Second}, true},
+		{"frames keep it alive", []time.Duration{20 * time.Second, 20 * time.Second}, false},
+		{"silent after a frame", []time.Duration{20 * time.Second, 31 * time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			ss, srv := newTestServer(t, DefaultConfig(), WithClock(clock), WithClientTimeout(timeout))
+			registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+
+			for i, idle := range tt.idle {
+				if i > 0 {
+					if err := ss.AddFrame("cam", testFrame(64), FrameOptions{}); err != nil {
+						t.Fatalf("AddFrame: %v", err)
+					}
+				}
+				clock.Advance(idle)
+			}
+			removed := ss.removeInactiveClients()
+			if got := len(removed) == 1 && removed[0] == "cam"; got != tt.wantRemoved {
+				t.Errorf("removeInactiveClients() = %v, want cam removed: %v", removed, tt.wantRemoved)
+			}
+			if _, ok := ss.GetClient("cam"); ok == tt.wantRemoved {
+				t.Errorf("client still registered: %v, want %v", ok, !tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestExpiredFramesNotServed(t *testing.T) {
+	config := DefaultConfig()
+	config.FrameTTL = 30 * time.Second
+	clock := newFakeClock()
+	ss, srv := newTestServer(t, config, WithClock(clock))
+	registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+	for i := 0; i < 2; i++ {
+		if err := ss.AddFrame("cam", testFrame(64), FrameOptions{}); err != nil {
+			t.Fatalf("AddFrame %d: %v", i, err)
+		}
+		clock.Advance(20 * time.Second)
+	}
+
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := mux.SetURLVars(httptest.NewRequest("GET", target, nil), map[string]string{"id": "cam"})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	// The first frame is 40s old, the second 20s.
+	var frames []map[string]interface{}
+	if err := json.NewDecoder(get(ss.handleGetFrames, "/frames").Body).Decode(&frames); err != nil || len(frames) != 1 {
+		t.Errorf("/frames = %v (%v), want only the unexpired frame", frames, err)
+	}
+	if got := get(ss.handleExport, "/export.zip").Code; got != http.StatusOK {
+		t.Errorf("/export.zip with an unexpired frame = %d, want %d", got, http.StatusOK)
+	}
+
+	clock.Advance(20 * time.Second)
+	if got := strings.TrimSpace(get(ss.handleGetFrames, "/frames").Body.String()); got != "[]" {
+		t.Errorf("/frames after the TTL = %s, want []", got)
+	}
+	at := clock.Now().Add(-40 * time.Second).Format(time.RFC3339Nano)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		want    int
+	}{
+		{"frame", ss.handleGetFrameAt, "/frame?at=" + at, http.StatusNotFound},
+		{"thumbnail", ss.handleThumbnail, "/thumbnail", http.StatusNoContent},
+		{"clip", ss.handleClip, "/clip.gif", http.StatusNotFound},
+		{"export", ss.handleExport, "/export.zip", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := get(tt.handler, tt.target).Code; got != tt.want {
+			t.Errorf("%s after the TTL = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveExpiredDetached(t *testing.T) {
+	const grace = 10 * time.Second
+	config := DefaultConfig()
+	config.ReconnectGrace = grace
+	clock := newFakeClock()
+	ss, srv := newTestServer(t, config, WithClock(clock))
+	conn := registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+	client, _ := ss.GetClient("cam")
+	conn.Close()
+	waitFor(t, "the producer to be detached", func() bool { return !client.Connected() })
+
+	clock.Advance(grace)
+	if removed := ss.removeExpiredDetached(); len(removed) != 0 {
+		t.Errorf("removeExpiredDetached() at the end of the grace = %v, want none", removed)
+	}
+	if _, ok := ss.GetClient("cam"); !ok {
+		t.Fatal("detached client removed within its grace")
+	}
+	clock.Advance(time.Millisecond)
+	if removed := ss.removeExpiredDetached(); len(removed) != 1 || removed[0] != "cam" {
+		t.Errorf("removeExpiredDetached() past the grace = %v, want [cam]", removed)
+	}
+	if _, ok := ss.GetClient("cam"); ok {
+		t.Error("client still registered past its grace")
+	}
+}
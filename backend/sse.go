@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const SSE_HEARTBEAT = 15 * time.Second // Comment sent to keep idle proxies from closing the stream
+
+// handleEvents streams one client's frame updates as Server-Sent Events, for
+// frontends and proxies that cope better with SSE than WebSocket. Each event
+// carries the same JSON as a frame_update (or motion-alert) message. The
+// subscriber is an ordinary Viewer without a connection, so it gets the same
+// buffered, drop-on-slow delivery.
+func (ss *StreamServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	if _, ok := ss.GetClient(clientID); !ok {
+		clientNotFound(w)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal-error", "streaming unsupported")
+		return
+	}
+
+	quality := 0
+	if v := r.URL.Query().Get("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			badRequest(w, "quality must be between 1 and 100")
+			return
+		}
+		quality = n
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != FORMAT_WEBP && format != FORMAT_ORIGINAL {
+		badRequest(w, "format must be webp or original")
+		return
+	}
+
+	viewer := ss.newViewer(nil, r)
+	viewer.subscribe(clientID)
+	viewer.delta, _ = strconv.ParseBool(r.URL.Query().Get("delta"))
+	viewer.setQuality(quality)
+	viewer.setFormat(format)
+	if err := ss.addViewer(viewer, r); err != nil {
+		ss.rejectHTTP(w, http.StatusServiceUnavailable, "too-many-viewers")
+		return
+	}
+	defer ss.removeViewer(viewer, r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx response buffering
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": connected %s\n\n", viewer.sessionID)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(SSE_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ss.done:
+			return
+		case <-viewer.kick:
+			fmt.Fprintf(w, "data: %s\n\n", viewer.disconnectMessage())
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case message := <-viewer.send:
+			if message.msgType != websocket.TextMessage {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", message.data); err != nil {
+				return
+			}
+			flusher.Flush()
+			viewer.recordSent(message)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "regexp"
+
+// A producer can send several named streams (say, the wide and zoomed views
+// of one camera) over its connection by tagging frames with a streamId in
+// their frame-meta. Each named stream is registered as its own client under
+// "<clientId>/<streamId>", so buffering, viewers, stats, motion detection
+// and recording all work per stream unchanged, and REST routes accept the
+// composite ID in place of {id}. Untagged frames go to the plain clientId.
+
+const STREAM_SEPARATOR = "/"
+
+const RECORD_STREAMS = "streams" // Subdirectory of a client's recording holding its streams' recordings
+
+// CLIENT_ID_ROUTE matches a client ID in REST routes, optionally followed
+// by a stream ID.
+const CLIENT_ID_ROUTE = "{id:[^/]+(?:/[^/]+)?}"
+
+var streamIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// validStreamID reports whether id may name a stream.
+func validStreamID(id string) bool {
+	return streamIDPattern.MatchString(id)
+}
+
+// streamKey returns the client ID under which a producer's named stream is
+// registered.
+func streamKey(clientID, streamID string) string {
+	return clientID + STREAM_SEPARATOR + streamID
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serverTotals are cumulative counters for /api/summary. Unlike per-client
+// stats they survive clients disconnecting.
+type serverTotals struct {
+	framesReceived atomic.Uint64
+	bytesReceived  atomic.Uint64
+	peakViewers    atomic.Int64
+	clientsSeen    atomic.Uint64 // Registrations of an ID that wasn't already registered
+}
+
+// recordViewers raises the peak viewer count to n if it is higher.
+func (t *serverTotals) recordViewers(n int) {
+	for {
+		peak := t.peakViewers.Load()
+		if int64(n) <= peak || t.peakViewers.CompareAndSwap(peak, int64(n)) {
+			return
+		}
+	}
+}
+
+// handleSummary returns an at-a-glance status: uptime, traffic since start,
+// and current versus historical client and viewer counts.
+func (ss *StreamServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.RLock()
+	clientCount := len(ss.clients)
+	ss.mutex.RUnlock()
+	ss.viewersMutex.RLock()
+	viewerCount := len(ss.viewers)
+	ss.viewersMutex.RUnlock()
+
+	uptime := ss.clock.Since(ss.startTime).Round(time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"startTime":      ss.startTime,
+		"uptime":         uptime.String(),
+		"uptimeSeconds":  int64(uptime.Seconds()),
+		"framesReceived": ss.totals.framesReceived.Load(),
+		"bytesReceived":  ss.totals.bytesReceived.Load(),
+		"clients": map[string]uint64{
+			"connected": uint64(clientCount),
+			"seen":      ss.totals.clientsSeen.Load(),
+		},
+		"viewers": map[string]int64{
+			"connected": int64(viewerCount),
+			"peak":      ss.totals.peakViewers.Load(),
+		},
+	})
+}
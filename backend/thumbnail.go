@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	THUMBNAIL_WIDTH     = 160 // Default ?w= for thumbnails
+	THUMBNAIL_MAX_WIDTH = 1920
+	THUMBNAIL_QUALITY   = 75
+)
+
+// thumbnail is a cached, re-encoded copy of one frame.
+type thumbnail struct {
+	seq   uint64
+	width int
+	data  []byte
+}
+
+// thumbnail returns frame scaled to width as JPEG, reusing the client's
+// cached copy when it was made from the same frame at the same width.
+// Frames are never scaled up, nor decoded above maxPixels.
+func (c *Client) thumbnail(frame *Frame, width, maxPixels int) ([]byte, error) {
+	c.mutex.RLock()
+	cached := c.thumb
+	c.mutex.RUnlock()
+	if cached != nil && cached.seq == frame.Seq && cached.width == width {
+		return cached.data, nil
+	}
+
+	src, _, err := decodeImage(frame.Data, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	dst := scaleImage(src, width)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: THUMBNAIL_QUALITY}); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.thumb = &thumbnail{seq: frame.Seq, width: width, data: buf.Bytes()}
+	c.mutex.Unlock()
+	return buf.Bytes(), nil
+}
+
+// scaleImage resizes src to width pixels wide, keeping its aspect ratio.
+// Images narrower than width are copied at their own size.
+func scaleImage(src image.Image, width int) *image.RGBA {
+	b := src.Bounds()
+	w := min(width, b.Dx())
+	h := max(1, b.Dy()*w/max(1, b.Dx()))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// handleThumbnail returns the latest frame scaled to ?w= pixels wide as a
+// JPEG, for grid views that don't need full resolution.
+func (ss *StreamServer) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		clientNotFound(w)
+		return
+	}
+	width := THUMBNAIL_WIDTH
+	if v := r.URL.Query().Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > THUMBNAIL_MAX_WIDTH {
+			badRequest(w, "w must be between 1 and 1920")
+			return
+		}
+		width = n
+	}
+	frame := client.Buffer.GetLatest()
+	if frame == nil {
+		noFrames(w)
+		return
+	}
+	if ss.expired(frame) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, err := client.thumbnail(frame, width, ss.config.MaxDecodePixels)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "undecodable-frame", "frame could not be decoded")
+		return
+	}
+	ss.recordAccess(r, clientID, 1)
+	w.Header().Set("Content-Type", mimeType("jpeg"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Last-Modified", frame.Timestamp.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Frame-Timestamp", frame.Timestamp.Format(time.RFC3339Nano))
+	w.Header().Set("X-Frame-Capture-Time", frame.CaptureTime.Format(time.RFC3339Nano))
+	w.Header().Set("X-Frame-Seq", strconv.FormatUint(frame.Seq, 10))
+	w.Write(data)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTLSTestServer starts ss behind an httptest TLS server and returns a
+// dialer that trusts its certificate. The config's cert and key paths are
+// never read; they only turn on the TLS origin policy.
+func newTLSTestServer(t *testing.T) (*StreamServer, *httptest.Server, *websocket.Dialer) {
+	t.Helper()
+	config := DefaultConfig()
+	config.TLSCert, config.TLSKey = "cert.pem", "key.pem"
+	ss := NewStreamServer(config)
+	srv := httptest.NewTLSServer(testRouter(ss))
+	t.Cleanup(func() {
+		ss.Close()
+		srv.Close()
+	})
+	dialer := &websocket.Dialer{TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+	return ss, srv, dialer
+}
+
+func TestProducerRegistersOverWSS(t *testing.T) {
+	ss, srv, dialer := newTLSTestServer(t)
+	registerProducer(t, dialer, wsURL(srv, "/ws"), "cam")
+	client, ok := ss.GetClient("cam")
+	if !ok {
+		t.Fatal("client not registered over wss")
+	}
+	if got := client.Protocol(); got != PROTOCOL_V1 {
+		t.Errorf("Protocol() = %q, want %q", got, PROTOCOL_V1)
+	}
+}
+
+func TestTLSOriginPolicy(t *testing.T) {
+	_, srv, dialer := newTLSTestServer(t)
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"no origin", "", true},
+		{"https origin", "https://app.example.com", true},
+		{"http origin", "http://app.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			conn, resp, err := dialer.Dial(wsURL(srv, "/ws"), header)
+			if err == nil {
+				conn.Close()
+			}
+			if got := err == nil; got != tt.want {
+				t.Fatalf("upgrade accepted = %v, want %v (err %v)", got, tt.want, err)
+			}
+			if !tt.want && resp.StatusCode != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+			}
+		})
+	}
+}
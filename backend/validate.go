@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const MAX_CLIENT_ID_LENGTH = 64
+
+// Client IDs end up in URLs, metric labels and recording directory names,
+// so they are limited to characters that are safe in all three. A leading
+// dot is refused so "." and ".." can't name a directory.
+var clientIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// validClientID reports whether id may be used to register a producer.
+func validClientID(id string) bool {
+	return len(id) <= MAX_CLIENT_ID_LENGTH && clientIDPattern.MatchString(id)
+}
+
+// validSubscriptionID reports whether id names a client or one of its
+// named streams ("<clientId>/<streamId>").
+func validSubscriptionID(id string) bool {
+	clientID, streamID, isStream := strings.Cut(id, STREAM_SEPARATOR)
+	return validClientID(clientID) && (!isStream || validStreamID(streamID))
+}
+
+// decodeMessage strictly parses a control message into v. Unknown fields
+// are errors, so a misspelled field is reported instead of silently ignored.
+func decodeMessage(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// protocolError is sent to a producer or viewer whose control message was
+// rejected. The connection stays open.
+type protocolError struct {
+	Type   string `json:"type"` // Always "error"
+	Reason string `json:"reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func newProtocolError(reason, detail string) protocolError {
+	return protocolError{Type: "error", Reason: reason, Detail: detail}
+}
+
+// checkFrame applies AddFrame's checks that don't depend on the client: the
+// size limit, format detection and the declared format. It returns the
+// detected format and every check that failed, most important first.
+func (ss *StreamServer) checkFrame(data []byte, opts FrameOptions) (format string, errs []error) {
+	if len(data) > ss.config.MaxFrameSize {
+		errs = append(errs, ErrFrameTooLarge)
+	}
+	format, ok := detectFormat(data)
+	if !ok {
+		errs = append(errs, ErrUnknownFormat)
+	} else if opts.Format != "" && opts.Format != format {
+		errs = append(errs, ErrFormatMismatch)
+	}
+	return format, errs
+}
+
+// frameValidation is the response of handleValidateFrame.
+type frameValidation struct {
+	Valid          bool     `json:"valid"`
+	DetectedFormat string   `json:"detectedFormat"` // Empty when unrecognized
+	Size           int64    `json:"size"`
+	Checksum       *uint32  `json:"checksum,omitempty"` // CRC-32 (IEEE) of the body as producers send it; absent when too large
+	Reasons        []string `json:"reasons"`            // Why the frame would be rejected; empty when valid
+}
+
+// handleValidateFrame tells integrators whether a frame POSTed as the raw
+// body would be accepted by AddFrame, without storing it. "?format=" checks
+// it against a declared format and "?checksum=" against a producer checksum,
+// as a producer registered with verifyChecksums would send it. Rate limits
+// aren't checked, since they depend on the connection.
+func (ss *StreamServer) handleValidateFrame(w http.ResponseWriter, r *http.Request) {
+	var opts FrameOptions
+	if declared := r.URL.Query().Get("format"); declared != "" {
+		if opts.Format = normalizeFormat(declared); opts.Format == "" {
+			badRequest(w, "unsupported format, supported: "+strings.Join(supportedFormats, ", "))
+			return
+		}
+	}
+	if sum := r.URL.Query().Get("checksum"); sum != "" {
+		n, err := strconv.ParseUint(sum, 10, 32)
+		if err != nil {
+			badRequest(w, "invalid checksum, want a decimal CRC-32")
+			return
+		}
+		want := uint32(n)
+		opts.Checksum = &want
+	}
+
+	// Read one byte past the limit, enough to know the frame is too large
+	// without buffering an arbitrarily large body.
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(ss.config.MaxFrameSize)+1))
+	if err != nil {
+		badRequest(w, "could not read body")
+		return
+	}
+	format, errs := ss.checkFrame(data, opts)
+	result := frameValidation{
+		DetectedFormat: format,
+		Size:           int64(len(data)),
+		Reasons:        []string{},
+	}
+	if len(data) > ss.config.MaxFrameSize {
+		result.Size = max(r.ContentLength, result.Size) // Unknown past the limit unless declared
+	} else {
+		sum := crc32.ChecksumIEEE(data)
+		result.Checksum = &sum
+		if opts.Checksum != nil && *opts.Checksum != sum {
+			errs = append(errs, ErrChecksumMismatch)
+		}
+	}
+	for _, err := range errs {
+		result.Reasons = append(result.Reasons, err.Error())
+	}
+	result.Valid = len(errs) == 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
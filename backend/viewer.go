@@ -0,0 +1,1142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gen2brain/webp"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Viewer represents a subscribed client with a buffered channel for non-blocking sends.
+type Viewer struct {
+	conn *websocket.Conn
+	send chan outboundMessage // Buffered channel for outgoing messages; never closed
+	done chan struct{}        // Closed by removeViewer to stop delivery
+
+	sendMutex sync.Mutex // Held to queue on send, see replaceOldestFrame
+
+	sessionID string
+	identity  string // Authenticated principal, or the remote address when auth is off
+	started   time.Time
+	delivered atomic.Uint64 // Frames actually written to the connection
+	sent      rateWindow    // Recent writes, guarded by mutex
+	bytesOut  uint64        // Guarded by mutex
+	dropped   prometheus.Counter
+	unlogged  atomic.Uint64 // Drops not yet reported by logViewerDrops
+
+	mutex         sync.RWMutex
+	subscriptions map[string]bool          // Client IDs this viewer asked for
+	subscribed    bool                     // Set by the first subscribe; defaultAll no longer applies
+	minInterval   time.Duration            // Minimum spacing between frames of one stream
+	intervals     map[string]time.Duration // Per-client overrides of minInterval, see setClientMaxFps
+	lastSent      map[string]time.Time
+	lastSeq       map[string]deliveredSeq // Newest frame queued per client
+	binary        bool                    // Deliver frames as binary messages instead of base64 JSON
+	dropOldest    bool                    // Make room for new frames instead of discarding them
+	delta         bool                    // Send frame-unchanged instead of repeating an identical image
+	quality       int                     // JPEG quality to re-encode frames at, 0 for the original
+	webp          bool                    // Transcode frames to WebP, see webp.go
+	pace          chan struct{}           // Closed to stop paced delivery, nil when off; see setPace
+
+	lastPong   atomic.Int64  // UnixNano of the last pong or message, see cleanupIdleViewers
+	pingPeriod time.Duration // Time between pings written by writePump
+	writeWait  time.Duration // Time allowed for each write, see writePump
+	maxPixels  int           // Decode limit when re-encoding, see decodeImage
+	protocol   string        // Negotiated subprotocol, see protocolVersion
+	remoteAddr string
+
+	drops      dropWindow    // Recent drop rate, guarded by mutex; see recordOffered
+	kick       chan struct{} // Closed by disconnect
+	kickOnce   sync.Once
+	kickReason string
+}
+
+// Drop policies a viewer can choose for when its send buffer is full.
+const (
+	DROP_NEWEST = "drop-newest" // Discard the incoming frame (default)
+	DROP_OLDEST = "drop-oldest" // Discard the oldest queued frame, keeping the viewer near live
+)
+
+const (
+	DROP_LOG_INTERVAL   = 10 * time.Second // How often dropped frames are summarized in the log
+	VIEWER_AUTH_TIMEOUT = 10 * time.Second // Time allowed for a viewer's auth message
+)
+
+// deliveredSeq remembers the newest frame queued from one producer
+// connection; a re-registered client starts its sequence over. size and
+// checksum identify the image for delta mode.
+type deliveredSeq struct {
+	client   *Client
+	seq      uint64
+	size     int
+	checksum uint32
+}
+
+// outboundMessage is a websocket message queued for a viewer.
+type outboundMessage struct {
+	msgType int
+	data    []byte
+	image   bool // A frame's image, counted as delivered; not a notice or frame-unchanged
+	frame   bool // Queued by queueFrame, so drop-oldest may evict it; control messages never are
+}
+
+// viewerMessage is a control message sent by a viewer over /stream/ws.
+type viewerMessage struct {
+	Type      string   `json:"type"`
+	ClientID  string   `json:"clientId"`
+	ClientIDs []string `json:"clientIds"` // Several clients at once, for grid dashboards
+	MaxFps    float64  `json:"maxFps"`
+	Binary    *bool    `json:"binary"`
+	LastSeq   *uint64  `json:"lastSeq"` // Resume after this frame, see replayFrames
+	PaceFps   *float64 `json:"paceFps"` // Deliver at this steady rate, 0 for as frames arrive; see setPace
+
+	DropPolicy string `json:"dropPolicy"`
+	Delta      *bool  `json:"delta"`   // Opt in to frame-unchanged messages
+	Quality    *int   `json:"quality"` // Re-encode frames at this JPEG quality, 0 or 100 for the original
+	Format     string `json:"format"`  // FORMAT_WEBP or FORMAT_ORIGINAL, see setFormat
+
+	Token string `json:"token"` // auth messages only, see authenticateViewer
+}
+
+// setMaxFps caps this viewer's per-stream delivery rate. Values above
+// MAX_BROADCAST_FPS are clamped to the server-wide limit.
+func (v *Viewer) setMaxFps(fps float64) float64 {
+	fps = clampViewerFps(fps)
+	v.mutex.Lock()
+	v.minInterval = time.Duration(float64(time.Second) / fps)
+	v.mutex.Unlock()
+	return fps
+}
+
+// setClientMaxFps caps delivery of the given clients only, overriding the
+// viewer-wide rate for them, e.g. a detail view next to a slow grid.
+func (v *Viewer) setClientMaxFps(clientIDs []string, fps float64) float64 {
+	fps = clampViewerFps(fps)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.intervals == nil {
+		v.intervals = make(map[string]time.Duration)
+	}
+	for _, id := range clientIDs {
+		v.intervals[id] = time.Duration(float64(time.Second) / fps)
+	}
+	return fps
+}
+
+// clampViewerFps limits a requested delivery rate to MAX_BROADCAST_FPS,
+// which is also used for non-positive requests.
+func clampViewerFps(fps float64) float64 {
+	if fps <= 0 || fps > MAX_BROADCAST_FPS {
+		return MAX_BROADCAST_FPS
+	}
+	return fps
+}
+
+// allowFrame reports whether frame is newer than anything already queued
+// from client and enough time has passed since the last delivery, and if so
+// records it as delivered at now. In delta mode, unchanged reports that the
+// previous frame queued from client had the same size and checksum, so a
+// frame-unchanged message can be sent instead of the image. Paced viewers
+// are never allowed; their pacer delivers instead.
+func (v *Viewer) allowFrame(client *Client, frame *Frame, now time.Time) (allowed, unchanged bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if allowed, unchanged = v.frameDue(client, frame, now); !allowed {
+		return false, false
+	}
+	if v.lastSent == nil {
+		v.lastSent = make(map[string]time.Time)
+	}
+	v.lastSent[client.ID] = now
+	v.markQueued(client, frame)
+	return true, unchanged
+}
+
+// peekFrame is allowFrame without recording anything.
+func (v *Viewer) peekFrame(client *Client, frame *Frame, now time.Time) (allowed, unchanged bool) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return v.frameDue(client, frame, now)
+}
+
+// frameDue is allowFrame's decision. Callers must hold v.mutex.
+func (v *Viewer) frameDue(client *Client, frame *Frame, now time.Time) (allowed, unchanged bool) {
+	if v.pace != nil || v.alreadyQueued(client, frame) {
+		return false, false
+	}
+	interval := v.minInterval
+	if d, ok := v.intervals[client.ID]; ok {
+		interval = d
+	}
+	if last, ok := v.lastSent[client.ID]; ok && now.Sub(last) < interval {
+		return false, false
+	}
+	if v.delta {
+		last, ok := v.lastSeq[client.ID]
+		unchanged = ok && last.client == client && last.size == frame.Size && last.checksum == frame.Checksum
+	}
+	return true, unchanged
+}
+
+// forgetImage clears what delta mode knows about the last image queued from
+// client, so the next frame is sent in full. Used when a frame was dropped
+// and the viewer may not be showing it.
+func (v *Viewer) forgetImage(client *Client) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if last, ok := v.lastSeq[client.ID]; ok {
+		last.size, last.checksum = 0, 0
+		v.lastSeq[client.ID] = last
+	}
+}
+
+// alreadyQueued reports whether frame was already queued for this viewer,
+// e.g. by a replay. Callers must hold v.mutex.
+func (v *Viewer) alreadyQueued(client *Client, frame *Frame) bool {
+	last, ok := v.lastSeq[client.ID]
+	return ok && last.client == client && frame.Seq <= last.seq
+}
+
+// markQueued records frame as the newest one queued from client. Callers
+// must hold v.mutex.
+func (v *Viewer) markQueued(client *Client, frame *Frame) {
+	if v.lastSeq == nil {
+		v.lastSeq = make(map[string]deliveredSeq)
+	}
+	v.lastSeq[client.ID] = deliveredSeq{client, frame.Seq, frame.Size, frame.Checksum}
+}
+
+func (v *Viewer) subscribe(clientID string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.subscriptions == nil {
+		v.subscriptions = make(map[string]bool)
+	}
+	v.subscriptions[clientID] = true
+	v.subscribed = true
+}
+
+// unsubscribe stops delivery of clientID and forgets its delivery state, so
+// a later subscribe starts fresh. A viewer that unsubscribes from its last
+// client receives nothing rather than falling back to every stream.
+func (v *Viewer) unsubscribe(clientID string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.subscriptions, clientID)
+	delete(v.lastSent, clientID)
+	delete(v.lastSeq, clientID)
+	delete(v.intervals, clientID)
+}
+
+// setQuality sets the JPEG quality frames are re-encoded at for this
+// viewer. 100 is treated as 0, the original frame.
+func (v *Viewer) setQuality(quality int) int {
+	if quality >= 100 {
+		quality = 0
+	}
+	v.mutex.Lock()
+	v.quality = quality
+	v.mutex.Unlock()
+	return quality
+}
+
+// setFormat switches the viewer to WebP delivery or back to the original
+// format, returning the format it will get.
+func (v *Viewer) setFormat(format string) string {
+	if format != FORMAT_WEBP {
+		format = FORMAT_ORIGINAL
+	} else {
+		go webp.Init() // Compile the encoder now rather than on the first frame
+	}
+	v.mutex.Lock()
+	v.webp = format == FORMAT_WEBP
+	v.mutex.Unlock()
+	return format
+}
+
+// wants reports whether frames from clientID should be delivered to this
+// viewer. Viewers that never subscribed fall back to defaultAll.
+func (v *Viewer) wants(clientID string, defaultAll bool) bool {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if !v.subscribed {
+		return defaultAll
+	}
+	return v.subscriptions[clientID]
+}
+
+// subscribedCameras lists the client IDs this viewer receives, using "*"
+// for the implicit all-streams subscription.
+func (v *Viewer) subscribedCameras(defaultAll bool) []string {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if !v.subscribed {
+		if defaultAll {
+			return []string{"*"}
+		}
+		return nil
+	}
+	ids := make([]string, 0, len(v.subscriptions))
+	for id := range v.subscriptions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// recordSent accounts for message having been written to the viewer.
+func (v *Viewer) recordSent(message outboundMessage) {
+	n := len(message.data)
+	v.mutex.Lock()
+	v.bytesOut += uint64(n)
+	v.sent.add(time.Now(), n)
+	v.mutex.Unlock()
+	if message.image {
+		v.delivered.Add(1)
+	}
+}
+
+// Bandwidth returns the bytes written to the viewer and the recent rate.
+func (v *Viewer) Bandwidth() (bytesOut uint64, bytesPerSec float64) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	_, bytesPerSec = v.sent.rates()
+	return v.bytesOut, bytesPerSec
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// frameMessage encodes one frame for delivery to viewers. Each wire format
+// is produced at most once per frame and shared by every viewer that uses it.
+type frameMessage struct {
+	clientID string
+	frame    *Frame
+	stats    ClientStats
+
+	jsonOnce   sync.Once
+	jsonData   []byte
+	binaryOnce sync.Once
+	binaryData []byte
+
+	unchangedOnce sync.Once
+	unchangedData []byte
+
+	reencoded qualityVariants // Re-encoded copies, see withQuality
+}
+
+// JSON returns the frame_update text message with a base64 data URI.
+func (m *frameMessage) JSON() []byte {
+	m.jsonOnce.Do(func() {
+		m.jsonData, _ = json.Marshal(map[string]interface{}{
+			"type":        "frame_update",
+			"clientId":    m.clientID,
+			"image":       dataURI(m.frame),
+			"seq":         m.frame.Seq,
+			"timestamp":   m.frame.Timestamp,
+			"captureTime": m.frame.CaptureTime,
+			"size":        m.frame.Size,
+			"checksum":    m.frame.Checksum,
+			"stats":       m.stats,
+		})
+	})
+	return m.jsonData
+}
+
+// Binary returns the frame as a binary message: a big-endian uint16 client
+// ID length, the client ID, the timestamp as big-endian int64 Unix
+// milliseconds, the big-endian uint64 sequence number, then the raw image
+// bytes.
+func (m *frameMessage) Binary() []byte {
+	m.binaryOnce.Do(func() {
+		buf := make([]byte, 2+len(m.clientID)+16+len(m.frame.Data))
+		binary.BigEndian.PutUint16(buf, uint16(len(m.clientID)))
+		n := 2 + copy(buf[2:], m.clientID)
+		binary.BigEndian.PutUint64(buf[n:], uint64(m.frame.Timestamp.UnixMilli()))
+		binary.BigEndian.PutUint64(buf[n+8:], m.frame.Seq)
+		copy(buf[n+16:], m.frame.Data)
+		m.binaryData = buf
+	})
+	return m.binaryData
+}
+
+// Unchanged returns the frame-unchanged text message sent to delta-mode
+// viewers in place of an image identical to the previous one.
+func (m *frameMessage) Unchanged() outboundMessage {
+	m.unchangedOnce.Do(func() {
+		m.unchangedData, _ = json.Marshal(map[string]interface{}{
+			"type":        "frame-unchanged",
+			"clientId":    m.clientID,
+			"seq":         m.frame.Seq,
+			"timestamp":   m.frame.Timestamp,
+			"captureTime": m.frame.CaptureTime,
+			"stats":       m.stats,
+		})
+	})
+	return outboundMessage{websocket.TextMessage, m.unchangedData, false, false}
+}
+
+// queueFrame queues a frame message without blocking. When the send buffer
+// is full, drop-newest discards m and drop-oldest discards the oldest queued
+// frame message to make room for it; control messages are never discarded
+// for a frame. It reports whether m was queued and whether anything was
+// discarded.
+func (v *Viewer) queueFrame(m outboundMessage) (queued, dropped bool) {
+	m.frame = true
+	if v.trySend(m) {
+		return true, false
+	}
+	if v.closed() {
+		return false, false
+	}
+	v.mutex.RLock()
+	dropOldest := v.dropOldest
+	v.mutex.RUnlock()
+	v.dropped.Inc()
+	v.unlogged.Add(1)
+	if !dropOldest {
+		return false, true
+	}
+	return v.replaceOldestFrame(m), true
+}
+
+// replaceOldestFrame discards the oldest queued frame message and queues m,
+// keeping the order of everything else. A channel can only be read from the
+// front, so the queue is drained and refilled while sendMutex keeps other
+// senders out; writePump may still take messages meanwhile, which only makes
+// room. It reports whether m was queued, which needs a frame to evict unless
+// writePump freed a slot.
+func (v *Viewer) replaceOldestFrame(m outboundMessage) bool {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+	if v.closed() {
+		return false
+	}
+	queued := make([]outboundMessage, 0, cap(v.send))
+	evicted := false
+drain:
+	for {
+		select {
+		case old := <-v.send:
+			if old.frame && !evicted {
+				evicted = true
+				continue
+			}
+			queued = append(queued, old)
+		default:
+			break drain
+		}
+	}
+	for _, old := range queued {
+		v.send <- old // Never blocks: at most what was just drained
+	}
+	select {
+	case v.send <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// trySend queues m without blocking. It reports false if the send buffer is
+// full or the viewer has been removed.
+//
+// send is never closed, so a sender racing with removeViewer can't panic;
+// once done is closed nothing reads send again and pending messages are
+// garbage collected with the viewer.
+func (v *Viewer) trySend(m outboundMessage) bool {
+	if v.closed() {
+		return false
+	}
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+	select {
+	case v.send <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// closed reports whether removeViewer has run.
+func (v *Viewer) closed() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// forViewer picks the encoding and quality the viewer negotiated.
+func (m *frameMessage) forViewer(v *Viewer) outboundMessage {
+	v.mutex.RLock()
+	useBinary, quality, webp := v.binary, v.quality, v.webp
+	v.mutex.RUnlock()
+	m = m.withQuality(quality, webp, v.maxPixels)
+	if useBinary {
+		return outboundMessage{websocket.BinaryMessage, m.Binary(), true, false}
+	}
+	return outboundMessage{websocket.TextMessage, m.JSON(), true, false}
+}
+
+// broadcastFrame sends a frame to all subscribed viewers using non-blocking channel sends.
+func (ss *StreamServer) broadcastFrame(client *Client, frame *Frame) {
+	if client.Paused() {
+		return // Still buffered, see handleAdminPause
+	}
+	clientID := client.ID
+	now := ss.clock.Now()
+
+	// Re-encoding for a viewer's quality or format is slow, so the messages
+	// viewers are due are encoded and cached on msg before the viewers lock
+	// is taken for queueing. Only a viewer that subscribes or changes its
+	// settings in between has its message encoded under the lock.
+	ss.viewersMutex.RLock()
+	var due bool
+	var images []*Viewer
+	for viewer := range ss.viewers {
+		if !viewer.wants(clientID, ss.config.SubscribeAll) {
+			continue
+		}
+		if allowed, unchanged := viewer.peekFrame(client, frame, now); allowed {
+			due = true
+			if !unchanged {
+				images = append(images, viewer)
+			}
+		}
+	}
+	ss.viewersMutex.RUnlock()
+	if !due {
+		return
+	}
+	msg := &frameMessage{
+		clientID: clientID,
+		frame:    frame,
+		stats:    client.Stats(),
+	}
+	for _, viewer := range images {
+		msg.forViewer(viewer)
+	}
+
+	ss.viewersMutex.RLock()
+	defer ss.viewersMutex.RUnlock()
+	for viewer := range ss.viewers {
+		if !viewer.wants(clientID, ss.config.SubscribeAll) {
+			continue
+		}
+		allowed, unchanged := viewer.allowFrame(client, frame, now)
+		if !allowed {
+			continue
+		}
+		var out outboundMessage
+		if unchanged {
+			out = msg.Unchanged()
+		} else {
+			out = msg.forViewer(viewer)
+		}
+		queued, dropped := viewer.queueFrame(out)
+		if !queued {
+			viewer.forgetImage(client)
+		}
+		ss.checkSlowViewer(viewer, dropped, now)
+	}
+}
+
+// announceClient tells clientID's viewers that it connected or went away,
+// so a UI can swap in an offline placeholder without waiting for frames to
+// stop. reason is omitted when empty.
+func (ss *StreamServer) announceClient(msgType, clientID, reason string) {
+	msg := map[string]string{"type": msgType, "clientId": clientID}
+	if reason != "" {
+		msg["reason"] = reason
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	ss.broadcastJSON(clientID, data)
+}
+
+// broadcastJSON sends a text message about clientID to every viewer
+// receiving its stream, dropping it for viewers whose buffer is full.
+func (ss *StreamServer) broadcastJSON(clientID string, data []byte) {
+	ss.viewersMutex.RLock()
+	defer ss.viewersMutex.RUnlock()
+	for viewer := range ss.viewers {
+		if viewer.wants(clientID, ss.config.SubscribeAll) {
+			viewer.trySend(outboundMessage{websocket.TextMessage, data, false, false})
+		}
+	}
+}
+
+// replayFrames queues clientID's buffered frames newer than lastSeq so a
+// reconnecting viewer resumes without a gap, bounded by the ring buffer. It
+// holds the viewers lock so no live frame is queued ahead of the replay;
+// allowFrame then skips live frames the replay already covered. Frames are
+// encoded for the viewer before the lock is taken. It returns the number of
+// frames queued.
+func (ss *StreamServer) replayFrames(viewer *Viewer, clientID string, lastSeq uint64) int {
+	client, ok := ss.GetClient(clientID)
+	if !ok || client.Paused() {
+		return 0
+	}
+	stats := client.Stats()
+	encoded := make(map[uint64]*frameMessage)
+	for _, frame := range client.Buffer.GetSince(lastSeq) {
+		if ss.expired(frame) {
+			continue
+		}
+		msg := &frameMessage{clientID: clientID, frame: frame, stats: stats}
+		msg.forViewer(viewer)
+		encoded[frame.Seq] = msg
+	}
+	ss.viewersMutex.Lock()
+	defer ss.viewersMutex.Unlock()
+	queued := 0
+	for _, frame := range client.Buffer.GetSince(lastSeq) {
+		if ss.expired(frame) {
+			continue
+		}
+		msg, ok := encoded[frame.Seq]
+		if !ok {
+			msg = &frameMessage{clientID: clientID, frame: frame, stats: stats} // Arrived since
+		}
+		if ok, _ := viewer.queueFrame(msg.forViewer(viewer)); ok {
+			viewer.mutex.Lock()
+			viewer.markQueued(client, frame)
+			viewer.mutex.Unlock()
+			queued++
+		}
+	}
+	return queued
+}
+
+// sendLatestFrame queues clientID's latest frame for viewer alone, as a
+// full image even in delta mode, so a viewer with nothing on screen needn't
+// wait for the next change. Like replayFrames it holds the viewers lock and
+// marks the frame queued, so live delivery carries on after it in order. It
+// returns the protocol error reason when there is nothing to send.
+func (ss *StreamServer) sendLatestFrame(viewer *Viewer, clientID string) string {
+	client, ok := ss.GetClient(clientID)
+	if !ok {
+		return "client-not-found"
+	}
+	if client.Paused() {
+		return "client-paused"
+	}
+	var msg *frameMessage
+	if frame := client.Buffer.GetLatest(); frame != nil {
+		msg = &frameMessage{clientID: clientID, frame: frame, stats: client.Stats()}
+		msg.forViewer(viewer) // Encoded before taking the lock
+	}
+	ss.viewersMutex.Lock()
+	defer ss.viewersMutex.Unlock()
+	frame := client.Buffer.GetLatest()
+	if frame == nil || ss.expired(frame) {
+		return "no-frames"
+	}
+	if msg == nil || msg.frame.Seq != frame.Seq {
+		msg = &frameMessage{clientID: clientID, frame: frame, stats: client.Stats()}
+	}
+	if ok, _ := viewer.queueFrame(msg.forViewer(viewer)); !ok {
+		return "send-buffer-full"
+	}
+	viewer.mutex.Lock()
+	viewer.markQueued(client, frame)
+	viewer.mutex.Unlock()
+	return ""
+}
+
+// writePump pumps messages from the channel to the websocket connection.
+// A ping is sent every pingPeriod so the read side can detect dead peers.
+// Each write must finish within writeWait; a viewer that can't keep up is
+// disconnected, and closing the connection makes its read loop exit and
+// remove it right away.
+func (v *Viewer) writePump() {
+	ticker := time.NewTicker(v.pingPeriod)
+	defer func() {
+		ticker.Stop()
+		v.conn.Close()
+	}()
+	for {
+		select {
+		case <-v.done:
+			v.conn.SetWriteDeadline(time.Now().Add(v.writeWait))
+			v.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case <-v.kick:
+			v.conn.SetWriteDeadline(time.Now().Add(v.writeWait))
+			v.conn.WriteMessage(websocket.TextMessage, v.disconnectMessage())
+			v.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, v.kickReason))
+			return
+		case message := <-v.send:
+			v.conn.SetWriteDeadline(time.Now().Add(v.writeWait))
+			// Binary frames are already-compressed images; deflating them
+			// again costs CPU for no gain. This is a no-op unless the
+			// viewer negotiated permessage-deflate.
+			v.conn.EnableWriteCompression(message.msgType == websocket.TextMessage)
+			if err := v.conn.WriteMessage(message.msgType, message.data); err != nil {
+				v.logWriteError(err)
+				return
+			}
+			v.recordSent(message)
+		case <-ticker.C:
+			v.conn.SetWriteDeadline(time.Now().Add(v.writeWait))
+			if err := v.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				v.logWriteError(err)
+				return
+			}
+		}
+	}
+}
+
+// logWriteError reports a write that timed out, which means the viewer
+// stopped reading. Other errors are ordinary disconnects.
+func (v *Viewer) logWriteError(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		slog.Info("disconnecting viewer: write timed out", "event", "viewer_write_timeout", "sessionId", v.sessionID, "remoteAddr", v.remoteAddr, "timeout", v.writeWait.String())
+	}
+}
+
+// logDrops logs how many frames the viewer dropped since the last report,
+// if any, and resets the count.
+func (v *Viewer) logDrops() {
+	if n := v.unlogged.Swap(0); n > 0 {
+		slog.Warn("dropped frames for slow viewer", "event", "viewer_drop", "sessionId", v.sessionID, "remoteAddr", v.remoteAddr, "dropped", n)
+	}
+}
+
+// logViewerDrops summarizes each viewer's dropped frames every
+// DROP_LOG_INTERVAL rather than logging every drop, which for a slow viewer
+// would mean a line per frame. Per-drop counts are in the
+// skysentry_viewer_dropped_frames_total metric.
+func (ss *StreamServer) logViewerDrops() {
+	ticker := time.NewTicker(DROP_LOG_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ticker.C:
+		}
+		ss.viewersMutex.RLock()
+		for viewer := range ss.viewers {
+			viewer.logDrops()
+		}
+		ss.viewersMutex.RUnlock()
+	}
+}
+
+// touch records that the viewer's connection is alive.
+func (v *Viewer) touch() {
+	v.lastPong.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long the viewer has gone without a pong or message.
+func (v *Viewer) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, v.lastPong.Load()))
+}
+
+// cleanupIdleViewers closes WebSocket viewers that haven't answered a ping
+// or sent anything within ViewerIdleTimeout. Closing the connection ends the
+// viewer's read loop, which removes it through removeViewer as usual. SSE
+// viewers have no pings and are left to their heartbeat writes.
+func (ss *StreamServer) cleanupIdleViewers() {
+	timeout := ss.config.ViewerIdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(timeout/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		ss.viewersMutex.RLock()
+		for viewer := range ss.viewers {
+			if viewer.conn == nil || viewer.idleFor(now) <= timeout {
+				continue
+			}
+			slog.Info("closing idle viewer", "event", "viewer_idle", "sessionId", viewer.sessionID, "remoteAddr", viewer.remoteAddr, "idle", viewer.idleFor(now).String())
+			viewer.conn.Close()
+		}
+		ss.viewersMutex.RUnlock()
+	}
+}
+
+// newViewer creates a viewer for a request. conn is nil for viewers that
+// are not served over a WebSocket, such as SSE.
+func (ss *StreamServer) newViewer(conn *websocket.Conn, r *http.Request) *Viewer {
+	viewer := &Viewer{
+		conn:        conn,
+		send:        make(chan outboundMessage, ss.config.ViewerBuffer),
+		done:        make(chan struct{}),
+		kick:        make(chan struct{}),
+		sessionID:   newSessionID(),
+		identity:    requestIdentity(r),
+		remoteAddr:  r.RemoteAddr,
+		started:     time.Now(),
+		minInterval: time.Second / MAX_BROADCAST_FPS,
+		pingPeriod:  PING_PERIOD,
+		writeWait:   ss.config.ViewerWriteTimeout,
+		maxPixels:   ss.config.MaxDecodePixels,
+		protocol:    protocolVersion(conn),
+	}
+	if idle := ss.config.ViewerIdleTimeout; idle > 0 {
+		// Ping often enough that a live viewer always answers in time.
+		viewer.pingPeriod = min(PING_PERIOD, idle/3)
+	}
+	viewer.touch()
+	viewer.dropped = ss.metrics.viewerDrops.WithLabelValues(viewer.sessionID)
+	return viewer
+}
+
+// addViewer starts delivering frames to viewer, or returns
+// ErrTooManyViewers once MaxViewers is reached.
+func (ss *StreamServer) addViewer(viewer *Viewer, r *http.Request) error {
+	ss.viewersMutex.Lock()
+	if ss.config.MaxViewers > 0 && len(ss.viewers) >= ss.config.MaxViewers {
+		ss.viewersMutex.Unlock()
+		slog.Warn("rejected viewer: viewer limit reached", "event", "viewer_rejected", "remoteAddr", r.RemoteAddr)
+		ss.metrics.viewerDrops.DeleteLabelValues(viewer.sessionID)
+		return ErrTooManyViewers
+	}
+	ss.viewers[viewer] = true
+	ss.totals.recordViewers(len(ss.viewers))
+	ss.viewersMutex.Unlock()
+	ss.notify("viewer_connected", "", viewer.sessionID)
+
+	ss.audit.Record(AuditEvent{
+		Event:        "viewer_session_start",
+		SessionID:    viewer.sessionID,
+		Identity:     viewer.identity,
+		RemoteAddr:   r.RemoteAddr,
+		Cameras:      viewer.subscribedCameras(ss.config.SubscribeAll),
+		Path:         r.URL.Path,
+		SessionStart: &viewer.started,
+	})
+	return nil
+}
+
+// removeViewer stops delivery to viewer. It is the only place done is
+// closed, and it runs once, when the viewer's request handler returns.
+func (ss *StreamServer) removeViewer(viewer *Viewer, r *http.Request) {
+	ss.viewersMutex.Lock()
+	delete(ss.viewers, viewer)
+	ss.viewersMutex.Unlock()
+	close(viewer.done)
+	viewer.logDrops() // Whatever the last interval didn't report
+	ss.metrics.viewerDrops.DeleteLabelValues(viewer.sessionID)
+	ss.notify("viewer_disconnected", "", viewer.sessionID)
+	ss.audit.Record(AuditEvent{
+		Event:           "viewer_session_end",
+		SessionID:       viewer.sessionID,
+		Identity:        viewer.identity,
+		RemoteAddr:      r.RemoteAddr,
+		Cameras:         viewer.subscribedCameras(ss.config.SubscribeAll),
+		Path:            r.URL.Path,
+		SessionStart:    &viewer.started,
+		SessionEnd:      timePtr(time.Now()),
+		FramesDelivered: viewer.delivered.Load(),
+	})
+}
+
+func (ss *StreamServer) handleStreamingWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(&ss.viewerUpgrader, w, r)
+	if err != nil {
+		return
+	}
+	principal, ok := ss.authenticateViewer(conn, r)
+	if !ok {
+		slog.Warn("rejected viewer: unauthorized", "event", "viewer_rejected", "remoteAddr", r.RemoteAddr, "reason", "unauthorized")
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.WriteJSON(newProtocolError("unauthorized", "a valid viewer token is required"))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"))
+		conn.Close()
+		return
+	}
+	viewer := ss.newViewer(conn, withPrincipal(r, principal))
+	if err := ss.addViewer(viewer, r); err != nil {
+		ss.rejectWebSocket(conn, "error", "too-many-viewers")
+		return
+	}
+	go viewer.writePump()
+
+	// Read control messages until the viewer goes away. A viewer that stops
+	// answering pings hits the read deadline and is removed.
+	defer ss.removeViewer(viewer, r)
+	conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
+		viewer.touch()
+		return nil
+	})
+	limiter := newMessageLimiter(ss.config.MessageRate)
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if !limiter.allow() {
+			slog.Warn("disconnecting viewer: message rate exceeded", "event", "message_rate_exceeded", "sessionId", viewer.sessionID, "remoteAddr", r.RemoteAddr, "limit", ss.config.MessageRate)
+			closePolicyViolation(conn, "message rate exceeded")
+			break
+		}
+		viewer.touch()
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		var msg viewerMessage
+		if err := decodeMessage(data, &msg); err != nil {
+			viewer.sendJSON(newProtocolError("malformed-message", err.Error()))
+			continue
+		}
+		ss.handleViewerMessage(viewer, r, msg)
+	}
+}
+
+// authenticateViewer checks a viewer's token before it is added, when viewer
+// authentication is enabled. The token comes from "?token=" or, failing
+// that, a {"type":"auth","token":"..."} first message, which must arrive
+// within VIEWER_AUTH_TIMEOUT and is answered with "authenticated". It
+// returns the authenticated principal, empty when authentication is off.
+func (ss *StreamServer) authenticateViewer(conn *websocket.Conn, r *http.Request) (string, bool) {
+	if ss.authorizeViewer == nil {
+		return "", true
+	}
+	if token := viewerToken(r); token != "" {
+		return ss.authorizeViewer("", token)
+	}
+	conn.SetReadDeadline(time.Now().Add(VIEWER_AUTH_TIMEOUT))
+	msgType, data, err := conn.ReadMessage()
+	if err != nil || msgType != websocket.TextMessage {
+		return "", false
+	}
+	var msg viewerMessage
+	if err := decodeMessage(data, &msg); err != nil || msg.Type != "auth" {
+		return "", false
+	}
+	principal, ok := ss.authorizeViewer("", msg.Token)
+	if !ok {
+		return "", false
+	}
+	conn.WriteJSON(map[string]string{"type": "authenticated"}) // writePump hasn't started yet
+	return principal, true
+}
+
+// handleViewerMessage applies a control message received from a viewer.
+func (ss *StreamServer) handleViewerMessage(viewer *Viewer, r *http.Request, msg viewerMessage) {
+	switch msg.Type {
+	case "subscribe":
+		if !validSubscriptionIDs(viewer, msg) {
+			return
+		}
+		if msg.DropPolicy != "" && msg.DropPolicy != DROP_NEWEST && msg.DropPolicy != DROP_OLDEST {
+			viewer.sendJSON(newProtocolError("invalid-drop-policy", "dropPolicy must be drop-newest or drop-oldest"))
+			return
+		}
+		if msg.Quality != nil && (*msg.Quality < 0 || *msg.Quality > 100) {
+			viewer.sendJSON(newProtocolError("invalid-quality", "quality must be between 1 and 100, or 0 for the original"))
+			return
+		}
+		if msg.Format != "" && msg.Format != FORMAT_WEBP && msg.Format != FORMAT_ORIGINAL {
+			viewer.sendJSON(newProtocolError("invalid-format", "format must be webp or original"))
+			return
+		}
+		ack := map[string]interface{}{"type": "subscribed"}
+		if msg.ClientID != "" {
+			viewer.subscribe(msg.ClientID)
+			ss.audit.Record(AuditEvent{
+				Event:      "viewer_subscribe",
+				SessionID:  viewer.sessionID,
+				Identity:   viewer.identity,
+				RemoteAddr: r.RemoteAddr,
+				Cameras:    []string{msg.ClientID},
+			})
+			ack["clientId"] = msg.ClientID
+			if msg.LastSeq != nil {
+				ack["replayed"] = ss.replayFrames(viewer, msg.ClientID, *msg.LastSeq)
+			}
+		}
+		if len(msg.ClientIDs) > 0 {
+			for _, id := range msg.ClientIDs {
+				viewer.subscribe(id)
+			}
+			ss.audit.Record(AuditEvent{
+				Event:      "viewer_subscribe",
+				SessionID:  viewer.sessionID,
+				Identity:   viewer.identity,
+				RemoteAddr: r.RemoteAddr,
+				Cameras:    msg.ClientIDs,
+			})
+			ack["clientIds"] = viewer.subscribedCameras(false)
+		}
+		if msg.MaxFps != 0 {
+			// With client IDs the rate applies to those clients only.
+			ids := msg.ClientIDs
+			if msg.ClientID != "" {
+				ids = append([]string{msg.ClientID}, ids...)
+			}
+			if len(ids) > 0 {
+				ack["maxFps"] = viewer.setClientMaxFps(ids, msg.MaxFps)
+			} else {
+				ack["maxFps"] = viewer.setMaxFps(msg.MaxFps)
+			}
+		}
+		if msg.Binary != nil {
+			viewer.mutex.Lock()
+			viewer.binary = *msg.Binary
+			viewer.mutex.Unlock()
+			ack["binary"] = *msg.Binary
+		}
+		if msg.Delta != nil {
+			viewer.mutex.Lock()
+			viewer.delta = *msg.Delta
+			viewer.mutex.Unlock()
+			ack["delta"] = *msg.Delta
+		}
+		if msg.Quality != nil {
+			ack["quality"] = viewer.setQuality(*msg.Quality)
+		}
+		if msg.Format != "" {
+			ack["format"] = viewer.setFormat(msg.Format)
+		}
+		if msg.PaceFps != nil {
+			ack["paceFps"] = ss.setPace(viewer, *msg.PaceFps)
+		}
+		if msg.DropPolicy == DROP_NEWEST || msg.DropPolicy == DROP_OLDEST {
+			viewer.mutex.Lock()
+			viewer.dropOldest = msg.DropPolicy == DROP_OLDEST
+			viewer.mutex.Unlock()
+			ack["dropPolicy"] = msg.DropPolicy
+		}
+		viewer.sendJSON(ack)
+	case "unsubscribe":
+		if !validSubscriptionIDs(viewer, msg) {
+			return
+		}
+		ids := msg.ClientIDs
+		if msg.ClientID != "" {
+			ids = append(ids, msg.ClientID)
+		}
+		for _, id := range ids {
+			viewer.unsubscribe(id)
+		}
+		ss.audit.Record(AuditEvent{
+			Event:      "viewer_unsubscribe",
+			SessionID:  viewer.sessionID,
+			Identity:   viewer.identity,
+			RemoteAddr: r.RemoteAddr,
+			Cameras:    ids,
+		})
+		viewer.sendJSON(map[string]interface{}{
+			"type":      "unsubscribed",
+			"clientIds": viewer.subscribedCameras(false),
+		})
+	case "request-frame":
+		if !validSubscriptionID(msg.ClientID) {
+			viewer.sendJSON(newProtocolError("invalid-client-id", msg.ClientID))
+			return
+		}
+		if reason := ss.sendLatestFrame(viewer, msg.ClientID); reason != "" {
+			viewer.sendJSON(newProtocolError(reason, msg.ClientID))
+		}
+	case "auth":
+		// Already authorized by authenticateViewer (or auth is off); clients
+		// that always send auth first get the same reply either way.
+		viewer.sendJSON(map[string]string{"type": "authenticated"})
+	default:
+		viewer.sendJSON(newProtocolError("unknown-message-type", msg.Type))
+	}
+}
+
+// validSubscriptionIDs checks the client IDs named in a subscribe or
+// unsubscribe message, reporting the first invalid one to the viewer.
+func validSubscriptionIDs(viewer *Viewer, msg viewerMessage) bool {
+	ids := msg.ClientIDs
+	if msg.ClientID != "" {
+		ids = append([]string{msg.ClientID}, ids...)
+	}
+	for _, id := range ids {
+		if !validSubscriptionID(id) {
+			viewer.sendJSON(newProtocolError("invalid-client-id", id))
+			return false
+		}
+	}
+	return true
+}
+
+// sendJSON queues a control message for the viewer, dropping it if the
+// send buffer is full.
+func (v *Viewer) sendJSON(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	v.trySend(outboundMessage{websocket.TextMessage, data, false, false})
+}
+
+// subscribedViewer describes one viewer in handleGetClientViewers.
+type subscribedViewer struct {
+	SessionID  string    `json:"sessionId"`
+	Identity   string    `json:"identity"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Transport  string    `json:"transport"` // "websocket" or "sse"
+	Since      time.Time `json:"since"`
+}
+
+// handleGetClientViewers reports how many viewers currently receive a
+// client's stream, including those covered by the implicit all-streams
+// subscription. Individual viewers and their addresses are only listed
+// for requests carrying the admin token.
+func (ss *StreamServer) handleGetClientViewers(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	admin := adminRequest(r, ss.config.AdminToken)
+	count := 0
+	viewers := []subscribedViewer{}
+	ss.viewersMutex.RLock()
+	for viewer := range ss.viewers {
+		if !viewer.wants(clientID, ss.config.SubscribeAll) {
+			continue
+		}
+		count++
+		if admin {
+			transport := "websocket"
+			if viewer.conn == nil {
+				transport = "sse"
+			}
+			viewers = append(viewers, subscribedViewer{viewer.sessionID, viewer.identity, viewer.remoteAddr, transport, viewer.started})
+		}
+	}
+	ss.viewersMutex.RUnlock()
+
+	resp := map[string]interface{}{"clientId": clientID, "count": count}
+	if admin {
+		sort.Slice(viewers, func(i, j int) bool { return viewers[i].Since.Before(viewers[j].Since) })
+		resp["viewers"] = viewers
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func viewerCount(ss *StreamServer) int {
+	ss.viewersMutex.RLock()
+	defer ss.viewersMutex.RUnlock()
+	return len(ss.viewers)
+}
+
+// connectViewer opens /stream/ws and sends subscribe, returning once it is
+// acknowledged, which means the server has added the viewer.
+func connectViewer(t *testing.T, srv *httptest.Server, subscribe map[string]interface{}) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/stream/ws"), nil)
+	if err != nil {
+		t.Fatalf("dial viewer: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	msg := map[string]interface{}{"type": "subscribe"}
+	for k, v := range subscribe {
+		msg[k] = v
+	}
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatalf("send subscribe: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var reply map[string]interface{}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("read subscribe reply: %v", err)
+		}
+		if reply["type"] == "subscribed" {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn
+}
+
+func TestMaxViewers(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxViewers = 2
+	ss, srv := newTestServer(t, config)
+	viewers := make([]*websocket.Conn, config.MaxViewers)
+	for i := range viewers {
+		viewers[i] = connectViewer(t, srv, nil)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/stream/ws"), nil)
+	if err != nil {
+		t.Fatalf("dial viewer %d: %v", config.MaxViewers+1, err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var refused rejection
+	if err := conn.ReadJSON(&refused); err != nil {
+		t.Fatalf("read refusal: %v", err)
+	}
+	if refused.Type != "error" || refused.Reason != "too-many-viewers" {
+		t.Errorf("refusal = %+v, want error too-many-viewers", refused)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("read after refusal = %v, want close %d", err, websocket.CloseTryAgainLater)
+	}
+	if got := viewerCount(ss); got != config.MaxViewers {
+		t.Errorf("viewers = %d, want %d", got, config.MaxViewers)
+	}
+
+	// A freed slot is available again.
+	viewers[0].Close()
+	waitFor(t, "the closed viewer to be removed", func() bool { return viewerCount(ss) < config.MaxViewers })
+	connectViewer(t, srv, nil)
+	if got := viewerCount(ss); got != config.MaxViewers {
+		t.Errorf("viewers after reconnecting = %d, want %d", got, config.MaxViewers)
+	}
+}
+
+func TestBlockedViewerDoesNotStallBroadcast(t *testing.T) {
+	const frames, frameSize = 64, 256 << 10 // Far more than the socket buffers hold
+	config := DefaultConfig()
+	config.ViewerWriteTimeout = 200 * time.Millisecond
+	config.SlowViewerDropRatio = 0 // Only the write timeout may disconnect
+	clock := newFakeClock()
+	ss, srv := newTestServer(t, config, WithClock(clock))
+	registerProducer(t, websocket.DefaultDialer, wsURL(srv, "/ws"), "cam")
+
+	binary := map[string]interface{}{"clientId": "cam", "binary": true}
+	connectViewer(t, srv, binary) // Never read from again
+	healthy := connectViewer(t, srv, binary)
+	received := make(chan struct{}, frames)
+	go func() {
+		for {
+			msgType, _, err := healthy.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msgType == websocket.BinaryMessage {
+				received <- struct{}{}
+			}
+		}
+	}()
+
+	for i := 0; i < frames; i++ {
+		clock.Advance(time.Second) // Stay under the per-viewer frame rate cap
+		if err := ss.AddFrame("cam", testFrame(frameSize), FrameOptions{}); err != nil {
+			t.Fatalf("AddFrame %d: %v", i, err)
+		}
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("healthy viewer stalled after %d of %d frames", i, frames)
+		}
+	}
+	waitFor(t, "the blocked viewer to be removed", func() bool { return viewerCount(ss) == 1 })
+}
+
+func TestDropOldestKeepsControlMessages(t *testing.T) {
+	config := DefaultConfig()
+	config.ViewerBuffer = 3
+	ss, _ := newTestServer(t, config)
+	viewer := ss.newViewer(nil, httptest.NewRequest("GET", "/stream/sse", nil))
+	viewer.dropOldest = true // Nothing reads send, so the buffer stays full
+
+	viewer.sendJSON(map[string]string{"type": "first"})
+	viewer.queueFrame(outboundMessage{msgType: websocket.TextMessage, data: []byte("frame 1")})
+	viewer.sendJSON(map[string]string{"type": "second"})
+	for _, frame := range []string{"frame 2", "frame 3"} {
+		if queued, dropped := viewer.queueFrame(outboundMessage{msgType: websocket.TextMessage, data: []byte(frame)}); !queued || !dropped {
+			t.Errorf("queueFrame(%s) = %v, %v; want queued after dropping a frame", frame, queued, dropped)
+		}
+	}
+	want := []string{`{"type":"first"}`, `{"type":"second"}`, "frame 3"}
+	for _, w := range want {
+		if got := string((<-viewer.send).data); got != w {
+			t.Errorf("queued %s, want %s", got, w)
+		}
+	}
+
+	// With only control messages queued, the frame is the one dropped.
+	for i := 0; i < config.ViewerBuffer; i++ {
+		viewer.sendJSON(map[string]string{"type": "notice"})
+	}
+	if queued, _ := viewer.queueFrame(outboundMessage{msgType: websocket.TextMessage, data: []byte("frame 4")}); queued {
+		t.Error("queueFrame evicted a control message")
+	}
+	if got := len(viewer.send); got != config.ViewerBuffer {
+		t.Errorf("queued %d messages, want %d", got, config.ViewerBuffer)
+	}
+}
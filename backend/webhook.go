@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOK_QUEUE    = 256 // Events waiting to be delivered
+	WEBHOOK_TIMEOUT  = 5 * time.Second
+	WEBHOOK_ATTEMPTS = 3
+	WEBHOOK_BACKOFF  = 500 * time.Millisecond // Doubled after each failed attempt
+)
+
+// WebhookEvent is the JSON body POSTed for connection changes.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	ClientID  string    `json:"clientId,omitempty"`
+	SessionID string    `json:"sessionId,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Clients   int       `json:"clients"`
+	Viewers   int       `json:"viewers"`
+}
+
+// Webhook delivers events to an HTTP endpoint from a single background
+// goroutine, so a slow endpoint never blocks connection handling. Events are
+// dropped when the queue is full. A nil *Webhook discards events.
+type Webhook struct {
+	url    string
+	client *http.Client
+	queue  chan WebhookEvent
+	done   chan struct{}
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+// NewWebhook starts a sender for url. An empty url disables webhooks and
+// returns nil.
+func NewWebhook(url string) *Webhook {
+	if url == "" {
+		return nil
+	}
+	wh := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		queue:  make(chan WebhookEvent, WEBHOOK_QUEUE),
+		done:   make(chan struct{}),
+	}
+	go wh.run()
+	return wh
+}
+
+// Send queues an event without blocking.
+func (wh *Webhook) Send(ev WebhookEvent) {
+	if wh == nil {
+		return
+	}
+	// Sending under the lock keeps Close from closing the queue underneath
+	// us; the send never blocks.
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+	if wh.closed {
+		return
+	}
+	select {
+	case wh.queue <- ev:
+	default:
+		slog.Warn("webhook queue full, dropping event", "event", "webhook_drop", "webhookEvent", ev.Event)
+	}
+}
+
+// Close stops the sender after the queued events have been attempted.
+// Events sent afterwards are discarded.
+func (wh *Webhook) Close() {
+	if wh == nil {
+		return
+	}
+	wh.mutex.Lock()
+	if !wh.closed {
+		wh.closed = true
+		close(wh.queue)
+	}
+	wh.mutex.Unlock()
+	<-wh.done
+}
+
+func (wh *Webhook) run() {
+	defer close(wh.done)
+	for ev := range wh.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		backoff := WEBHOOK_BACKOFF
+		for attempt := 1; ; attempt++ {
+			err = wh.post(body)
+			if err == nil || attempt == WEBHOOK_ATTEMPTS {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			slog.Error("webhook delivery failed", "event", "webhook_error", "webhookEvent", ev.Event, "err", err)
+		}
+	}
+}
+
+func (wh *Webhook) post(body []byte) error {
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// notify sends a connection event with the current totals. It takes the
+// client and viewer locks, so callers must not hold them.
+func (ss *StreamServer) notify(event, clientID, sessionID string) {
+	if ss.webhook == nil {
+		return
+	}
+	ss.mutex.RLock()
+	clients := len(ss.clients)
+	ss.mutex.RUnlock()
+	ss.viewersMutex.RLock()
+	viewers := len(ss.viewers)
+	ss.viewersMutex.RUnlock()
+	ss.webhook.Send(WebhookEvent{
+		Event:     event,
+		ClientID:  clientID,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Clients:   clients,
+		Viewers:   viewers,
+	})
+}
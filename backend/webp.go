@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"log/slog"
+
+	"github.com/gen2brain/webp"
+)
+
+const WEBP_QUALITY = 75 // Quality for WebP viewers that didn't ask for one
+
+// Viewer delivery formats, see the subscribe message's "format".
+const (
+	FORMAT_ORIGINAL = "original"
+	FORMAT_WEBP     = "webp"
+)
+
+// The standard library and x/image only decode WebP, so viewers that ask
+// for it have frames transcoded in-process by github.com/gen2brain/webp,
+// which uses the system's libwebp when it is installed and an embedded
+// WebAssembly build of it otherwise. Like quality variants, each frame is
+// transcoded at most once per quality and shared by every viewer that asked
+// for it. Frames that can't be decoded, or that wouldn't get smaller, are
+// sent as they would be without WebP.
+
+// encodeWebP returns a copy of frame transcoded to WebP at quality, or nil
+// if it can't be transcoded or the result isn't smaller.
+func encodeWebP(frame *Frame, quality, maxPixels int) *Frame {
+	img, _, err := decodeImage(frame.Data, maxPixels)
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, webp.Options{Quality: quality}); err != nil {
+		slog.Debug("webp encoding failed", "event", "webp_error", "seq", frame.Seq, "err", err)
+		return nil
+	}
+	if buf.Len() >= frame.Size {
+		return nil
+	}
+	encoded := *frame
+	encoded.Data = buf.Bytes()
+	encoded.Size = buf.Len()
+	encoded.Format = "webp"
+	encoded.Checksum = crc32.ChecksumIEEE(encoded.Data)
+	return &encoded
+}
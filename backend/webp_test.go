@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG returns a width×height gradient encoded as JPEG at quality 95.
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncodeWebP(t *testing.T) {
+	data := testJPEG(t, 320, 240)
+	frame := &Frame{Data: data, Size: len(data), Format: "jpeg", Seq: 7}
+	encoded := encodeWebP(frame, WEBP_QUALITY, MAX_DECODE_PIXELS)
+	if encoded == nil {
+		t.Fatal("encodeWebP returned nil for a decodable JPEG")
+	}
+	if format, _ := detectFormat(encoded.Data); format != "webp" || encoded.Format != "webp" {
+		t.Errorf("encoded format = %q (detected %q), want webp", encoded.Format, format)
+	}
+	if encoded.Size != len(encoded.Data) || encoded.Size >= frame.Size {
+		t.Errorf("encoded size = %d (%d bytes), want under %d", encoded.Size, len(encoded.Data), frame.Size)
+	}
+	if encoded.Seq != frame.Seq {
+		t.Errorf("encoded seq = %d, want %d", encoded.Seq, frame.Seq)
+	}
+
+	garbage := testFrame(64)
+	if got := encodeWebP(&Frame{Data: garbage, Size: len(garbage)}, WEBP_QUALITY, MAX_DECODE_PIXELS); got != nil {
+		t.Error("encodeWebP of an undecodable frame should return nil")
+	}
+}
+
+func TestWithQualityEncodesOnce(t *testing.T) {
+	data := testJPEG(t, 320, 240)
+	msg := &frameMessage{clientID: "cam", frame: &Frame{Data: data, Size: len(data), Format: "jpeg"}}
+	if got := msg.withQuality(0, false, MAX_DECODE_PIXELS); got != msg {
+		t.Error("the original variant should be the message itself")
+	}
+	tests := []struct {
+		quality    int
+		webp       bool
+		wantFormat string
+	}{
+		{30, false, "jpeg"},
+		{0, true, "webp"},
+		{30, true, "webp"},
+	}
+	for _, tt := range tests {
+		first := msg.withQuality(tt.quality, tt.webp, MAX_DECODE_PIXELS)
+		if first.frame.Format != tt.wantFormat || first.frame.Size >= len(data) {
+			t.Errorf("withQuality(%d, %v) = %s of %d bytes, want smaller %s", tt.quality, tt.webp, first.frame.Format, first.frame.Size, tt.wantFormat)
+		}
+		if again := msg.withQuality(tt.quality, tt.webp, MAX_DECODE_PIXELS); again != first {
+			t.Errorf("withQuality(%d, %v) encoded twice", tt.quality, tt.webp)
+		}
+	}
+}